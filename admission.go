@@ -0,0 +1,77 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var errChannelFull = errors.New("Channel has reached its maximum number of peers")
+
+// AdmissionRequest describes a local peer asking to join a channel. It is
+// passed to ServiceConfig.AdmitPeer before the peer's connection is upgraded.
+type AdmissionRequest struct {
+	// Name of the channel the peer wants to join
+	Channel string
+
+	// Origin of the web page making the request, if any
+	Origin string
+
+	// Remote address of the connection making the request
+	RemoteAddr string
+
+	// Websocket subprotocols requested by the peer (excluding bearer tokens)
+	Subprotocols []string
+
+	// Number of peers (local and remote) currently in the channel
+	Peers int
+}
+
+// Describe a local request to join the named channel
+func newAdmissionRequest(r *http.Request, channelName string, peers int) *AdmissionRequest {
+	request := &AdmissionRequest{
+		Channel:    channelName,
+		Origin:     r.Header.Get("Origin"),
+		RemoteAddr: r.RemoteAddr,
+		Peers:      peers,
+	}
+
+	for _, subprotocol := range strings.Split(r.Header.Get("Sec-Websocket-Protocol"), ",") {
+		if subprotocol = strings.TrimSpace(subprotocol); subprotocol != "" && !strings.HasPrefix(subprotocol, tokenSubprotocolPrefix) {
+			request.Subprotocols = append(request.Subprotocols, subprotocol)
+		}
+	}
+
+	return request
+}
+
+// Return the maximum number of peers allowed in the named channel. Zero means no limit.
+func (config *ServiceConfig) maxPeers(channelName string) int {
+	if maxPeers, ok := config.ChannelMaxPeers[channelName]; ok {
+		return maxPeers
+	}
+	return config.MaxPeers
+}
+
+// Return the number of local peer connections and remote peer connections
+// owned by proxy connections of this channel
+func (channel *Channel) countPeers() int {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	return channel.peerCount()
+}
+
+// Count local and remote peer connections. Must be called with channel.mu held.
+func (channel *Channel) peerCount() int {
+	count := len(channel.peers)
+	for _, proxy := range channel.proxies {
+		count += proxy.countPeerIds()
+	}
+	return count
+}
+
+// Whether this channel can admit another peer connection. Must be called with channel.mu held.
+func (channel *Channel) hasRoomForPeer() bool {
+	return channel.maxPeers <= 0 || channel.peerCount() < channel.maxPeers
+}
@@ -0,0 +1,127 @@
+package networkwebsockets
+
+import (
+	"log"
+)
+
+// Default number of incoming messages a Client queues for its callbacks, and
+// for each of its channels.
+const DefaultClientQueueSize = 255
+
+// ClientCallbacks receive the messages delivered to a Client created with
+// DialContext. Callbacks are called one at a time from a single goroutine.
+// Nil callbacks are skipped.
+type ClientCallbacks struct {
+	OnStatus     func(message WireMessage)
+	OnConnect    func(message WireMessage)
+	OnDisconnect func(message WireMessage)
+	OnMessage    func(message WireMessage)
+	OnBroadcast  func(message WireMessage)
+	OnUpdate     func(message WireMessage)
+
+	// Receives "error" messages sent by the service, e.g. when this client
+	// exceeds a rate limit
+	OnError func(message WireMessage)
+
+	// Number of incoming messages queued while a callback is running.
+	// Defaults to DefaultClientQueueSize.
+	QueueSize int
+
+	// What to do when an incoming message arrives and the queue is full
+	SlowConsumerPolicy SlowConsumerPolicy
+}
+
+// Queue an incoming message for this client's callbacks. When the queue is
+// full the client's SlowConsumerPolicy applies.
+func (client *Client) enqueue(message WireMessage) {
+	if !client.push(client.inbox, message) {
+		log.Printf("Client callbacks are not keeping up. Incoming '%s' message dropped.", message.Action)
+	}
+}
+
+// Push an incoming message on to the given queue, applying this client's
+// SlowConsumerPolicy if the queue is full. Returns whether the message was queued.
+func (client *Client) push(queue chan WireMessage, message WireMessage) bool {
+	for {
+		select {
+		case queue <- message:
+			return true
+		default:
+		}
+
+		switch client.callbacks.SlowConsumerPolicy {
+		case DropOldestMessage:
+			// Make room by discarding the message at the head of the queue
+			select {
+			case <-queue:
+			default:
+			}
+			continue
+
+		case DisconnectSlowConsumer:
+			client.Stop()
+		}
+
+		return false
+	}
+}
+
+// Pass queued incoming messages to this client's callbacks until it is stopped
+func (client *Client) runCallbacks() {
+	for {
+		select {
+		case message := <-client.inbox:
+			client.callback(message)
+		case <-client.quit:
+			return
+		}
+	}
+}
+
+func (client *Client) callback(message WireMessage) {
+	var callback func(message WireMessage)
+
+	switch message.Action {
+	case "status":
+		callback = client.callbacks.OnStatus
+	case "connect":
+		callback = client.callbacks.OnConnect
+	case "disconnect":
+		callback = client.callbacks.OnDisconnect
+	case "message":
+		callback = client.callbacks.OnMessage
+	case "broadcast":
+		callback = client.callbacks.OnBroadcast
+	case "update":
+		callback = client.callbacks.OnUpdate
+	case "error":
+		callback = client.callbacks.OnError
+	}
+
+	if callback != nil {
+		callback(message)
+	}
+}
+
+// Callbacks that deliver incoming messages on this client's channels. Each
+// channel applies the client's SlowConsumerPolicy when it is full so that a
+// channel nobody reads does not hold up the others.
+func (client *Client) channelCallbacks() ClientCallbacks {
+	deliverTo := func(queue chan WireMessage) func(message WireMessage) {
+		return func(message WireMessage) {
+			client.push(queue, message)
+		}
+	}
+
+	return ClientCallbacks{
+		OnStatus:     deliverTo(client.Status),
+		OnConnect:    deliverTo(client.Connect),
+		OnDisconnect: deliverTo(client.Disconnect),
+		OnMessage:    deliverTo(client.Message),
+		OnBroadcast:  deliverTo(client.Broadcast),
+		OnUpdate:     deliverTo(client.Update),
+		OnError:      deliverTo(client.Error),
+
+		SlowConsumerPolicy: DropOldestMessage,
+	}
+}
@@ -2,13 +2,24 @@ package networkwebsockets
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/richtr/bcrypt"
+	"github.com/richtr/websocket"
 )
 
+var errChannelClosed = errors.New("Channel has been stopped")
+
+var errDuplicateProxy = errors.New("Channel is already linked to this remote service")
+
 type Channel struct {
+	// The Service that manages this channel
+	service *Service
+
 	serviceName string
 
 	serviceHash string
@@ -17,155 +28,591 @@ type Channel struct {
 
 	proxyPath string
 
+	// Guards peers, proxies, dialing, undialed, discoveryService and closed
+	mu sync.RWMutex
+
 	// The current websocket connection instances to this named websocket
 	peers []*Peer
 
 	// The current websocket proxy connection instances to this named websocket
 	proxies []*Proxy
 
+	// Service hashes of the remote channels this channel is currently dialing
+	dialing map[string]bool
+
+	// When each remote channel with a higher service hash was first seen
+	// while this channel was not linked to it, keyed by service hash
+	undialed map[string]time.Time
+
 	// Buffered channel of outbound service messages.
 	broadcastBuffer chan *WireMessage
 
+	// Reassembles fragmented broadcast messages for local peers
+	reassembler *reassembler
+
+	// Limits the messages accepted from all connections of this channel. nil if unlimited.
+	limiter *rateLimiter
+
+	// Maximum number of local and remote peer connections. Zero for no limit.
+	maxPeers int
+
+	// Ids of broadcasts relayed through this channel in mesh mode
+	seen *seenMessages
+
 	// Attached DNS-SD discovery registration and browser for this Network Web Socket
 	discoveryService *DiscoveryService
 
+	// Whether this channel has been stopped
+	closed bool
+
+	quit    chan int // closed to ask the message dispatcher to drain and exit
+	drained chan int // closed once the message dispatcher has exited
+
 	done chan int // blocks until .Stop() is called
 }
 
 // Create a new Channel instance with a given service type
 func NewChannel(service *Service, serviceName string) *Channel {
-	serviceHash_BCrypt, _ := bcrypt.HashBytes([]byte(serviceName))
-	serviceHash_Base64 := base64.StdEncoding.EncodeToString(serviceHash_BCrypt)
+	channel := newChannel(service, serviceName)
+
+	service.mu.Lock()
+	service.Channels[channel.servicePath] = channel
+	service.mu.Unlock()
+
+	channel.start()
+	channel.dialCachedRecords()
+
+	return channel
+}
+
+// Build a new Channel instance without registering or starting it
+func newChannel(service *Service, serviceName string) *Channel {
+	// Reuse the hash and proxy path of a known channel with this name, if any
+	serviceHash_Base64, proxyPath := service.findStoredCredentials(serviceName)
+	if serviceHash_Base64 == "" {
+		serviceHash_BCrypt, _ := bcrypt.HashBytes([]byte(serviceName))
+		serviceHash_Base64 = base64.StdEncoding.EncodeToString(serviceHash_BCrypt)
+		proxyPath = fmt.Sprintf("/%s", GenerateId())
+	}
 
 	channel := &Channel{
+		service: service,
+
 		serviceName: serviceName,
 		serviceHash: serviceHash_Base64,
 
 		servicePath: fmt.Sprintf("/%s", serviceName),
+		proxyPath:   proxyPath,
 
 		peers:           make([]*Peer, 0),
 		proxies:         make([]*Proxy, 0),
+		dialing:         make(map[string]bool),
+		undialed:        make(map[string]time.Time),
 		broadcastBuffer: make(chan *WireMessage, 512),
 
+		reassembler: newReassembler(service.config.MaxReassembledMessageSize, service.config.ReassemblyTimeout),
+		limiter:     newRateLimiter(service.config.ChannelRateLimit),
+		maxPeers:    service.config.maxPeers(serviceName),
+		seen:        newSeenMessages(),
+
+		quit:    make(chan int),
+		drained: make(chan int),
+
 		done: make(chan int, 1),
 	}
 
-	channel.proxyPath = fmt.Sprintf("/%s", GenerateId())
+	return channel
+}
+
+// Start dispatching, advertising and resolving proxies for a Channel that has
+// been registered with its service
+func (channel *Channel) start() {
+	service := channel.service
 
 	go channel.messageDispatcher()
 
 	log.Printf("New '%s' channel peer created.", channel.serviceName)
 
-	service.Channels[channel.servicePath] = channel
+	// Add TLS-SRP credentials for access to this channel's proxy path
+	if err := service.storeCredentials(channel); err != nil {
+		log.Printf("err: %v", err)
+	}
+
+	go channel.advertise(service.getProxyPort(), service.config.DiscoveryPort)
+}
+
+// Dial the remote channels with this channel's name that were discovered
+// before this channel existed
+func (channel *Channel) dialCachedRecords() {
+	if discoveryBrowser := channel.service.getDiscoveryBrowser(); discoveryBrowser != nil {
+
+		// Attempt to resolve discovered unknown service hashes with this service name
+		for _, cachedRecord := range discoveryBrowser.resolveCachedRecords(channel.serviceName) {
+			if dErr := dialProxyFromDNSRecord(cachedRecord, channel); dErr != nil {
+				log.Printf("err: %v", dErr)
+			}
+		}
 
-	// Terminate channel when it is closed
-	go func() {
-		<-channel.stopNotify()
-		delete(service.Channels, channel.servicePath)
-	}()
+	}
+}
 
-	// Add TLS-SRP credentials for access to this service to credentials store
-	// TODO isolate this per socket
-	serviceTab[channel.serviceHash] = channel.serviceName
+func (channel *Channel) advertise(port, discoveryPort int) {
+	channel.mu.RLock()
+	advertised := channel.discoveryService != nil
+	channel.mu.RUnlock()
 
-	go channel.advertise(service.ProxyPort)
+	if advertised {
+		return
+	}
 
-	if service.discoveryBrowser != nil {
+	// Advertise new socket type on the network
+	discoveryService := NewDiscoveryService(channel.serviceName, channel.serviceHash, channel.proxyPath, port, discoveryPort)
+	discoveryService.Register("local")
 
-		// Attempt to resolve discovered unknown service hashes with this service name
-		recordsCache := make(map[string]*DNSRecord)
-		for _, cachedRecord := range service.discoveryBrowser.cachedDNSRecords {
-			if bcrypt.Match(channel.serviceName, cachedRecord.Hash_BCrypt) {
-				if dErr := dialProxyFromDNSRecord(cachedRecord, channel); dErr != nil {
-					log.Printf("err: %v", dErr)
-				}
-			} else {
-				// Maintain as an unresolved entry in cache
-				recordsCache[cachedRecord.Hash_Base64] = cachedRecord
+	channel.mu.Lock()
+	if channel.closed || channel.discoveryService != nil {
+		channel.mu.Unlock()
+		// Channel was stopped (or advertised) while we were registering
+		discoveryService.Shutdown()
+		return
+	}
+	channel.discoveryService = discoveryService
+	channel.mu.Unlock()
+}
+
+// Whether this channel has been stopped
+func (channel *Channel) isClosed() bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	return channel.closed
+}
+
+// Return a snapshot of the peer connections of this channel
+func (channel *Channel) getPeers() []*Peer {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	return append([]*Peer(nil), channel.peers...)
+}
+
+// Proxies returns a snapshot of the proxy links of this channel, including
+// links that are being re-established
+func (channel *Channel) Proxies() []*Proxy {
+	return channel.getProxies()
+}
+
+// Return a snapshot of the proxy connections of this channel
+func (channel *Channel) getProxies() []*Proxy {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	return append([]*Proxy(nil), channel.proxies...)
+}
+
+// Return the ids of all local peer connections and the peer connections
+// owned by proxy connections of this channel, except the given id
+func (channel *Channel) getPeerIds(except string) []string {
+	seen := map[string]bool{except: true}
+	peerIds := []string{}
+
+	for _, peer := range channel.getPeers() {
+		if !seen[peer.id] {
+			seen[peer.id] = true
+			peerIds = append(peerIds, peer.id)
+		}
+	}
+
+	for _, proxy := range channel.getProxies() {
+		for _, peerId := range proxy.getPeerIds() {
+			if !seen[peerId] {
+				seen[peerId] = true
+				peerIds = append(peerIds, peerId)
 			}
 		}
+	}
 
-		// Replace unresolved DNS-SD service entries cache
-		service.discoveryBrowser.cachedDNSRecords = recordsCache
+	return peerIds
+}
+
+// Whether the given id is already used by a local peer connection or by a peer
+// connection owned by a proxy connection other than the given one
+func (channel *Channel) isPeerIdTaken(id string, owner *Proxy) bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
 
+	return channel.hasPeerId(id, owner)
+}
+
+// Whether the given id belongs to a local peer connection, a proxy connection
+// or a peer connection owned by a proxy connection other than except. Must be
+// called with channel.mu held.
+func (channel *Channel) hasPeerId(id string, except *Proxy) bool {
+	for _, peer := range channel.peers {
+		if peer.id == id {
+			return true
+		}
 	}
 
-	return channel
+	for _, proxy := range channel.proxies {
+		if proxy.base.id == id || (proxy != except && proxy.hasPeerId(id)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find the local peer connection with the given id
+func (channel *Channel) getPeer(id string) *Peer {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	for _, peer := range channel.peers {
+		if peer.id == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Find the proxy connection that owns the given remote peer id
+func (channel *Channel) getProxyForPeer(id string) *Proxy {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	for _, proxy := range channel.proxies {
+		if proxy.hasPeerId(id) {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// Add a peer connection to this channel. Returns snapshots of the other peer
+// and proxy connections or errChannelClosed if the channel has been stopped.
+func (channel *Channel) addPeer(peer *Peer) ([]*Peer, []*Proxy, error) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	if channel.closed {
+		return nil, nil, errChannelClosed
+	}
+
+	if !channel.hasRoomForPeer() {
+		return nil, nil, errChannelFull
+	}
+
+	// Never reuse an id already known in this channel
+	for channel.hasPeerId(peer.id, nil) {
+		log.Printf("Peer id collision detected for '%s'. Assigning a new id.", peer.id)
+		peer.id = GenerateId()
+	}
+
+	others := append([]*Peer(nil), channel.peers...)
+
+	channel.peers = append(channel.peers, peer)
+
+	return others, append([]*Proxy(nil), channel.proxies...), nil
+}
+
+// Remove a peer connection from this channel. Returns snapshots of the
+// remaining peer and proxy connections.
+func (channel *Channel) removePeer(peer *Peer) ([]*Peer, []*Proxy) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	for i, conn := range channel.peers {
+		if conn == peer {
+			channel.peers[i] = nil // allow to be garbage-collected
+			channel.peers = append(channel.peers[:i], channel.peers[i+1:]...)
+			break
+		}
+	}
+
+	return append([]*Peer(nil), channel.peers...), append([]*Proxy(nil), channel.proxies...)
+}
+
+// Add a proxy connection to this channel. Returns a snapshot of the local
+// peer connections, errChannelClosed if the channel has been stopped or
+// errDuplicateProxy if the channel is already linked to the same remote channel.
+func (channel *Channel) addProxy(proxy *Proxy) ([]*Peer, error) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	if channel.closed {
+		return nil, errChannelClosed
+	}
+
+	if channel.hasProxyFor(proxy.Hash_Base64) {
+		return nil, errDuplicateProxy
+	}
+
+	channel.proxies = append(channel.proxies, proxy)
+
+	// Give the remote channel a full grace period again if this link is lost
+	delete(channel.undialed, proxy.Hash_Base64)
+
+	return append([]*Peer(nil), channel.peers...), nil
 }
 
-func (channel *Channel) advertise(port int) {
-	if channel.discoveryService == nil {
-		// Advertise new socket type on the network
-		channel.discoveryService = NewDiscoveryService(channel.serviceName, channel.serviceHash, channel.proxyPath, port)
-		channel.discoveryService.Register("local")
+// Remove a proxy connection from this channel. Returns a snapshot of the
+// local peer connections.
+func (channel *Channel) removeProxy(proxy *Proxy) []*Peer {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	for i, conn := range channel.proxies {
+		if conn == proxy {
+			channel.proxies[i] = nil // allow to be garbage-collected
+			channel.proxies = append(channel.proxies[:i], channel.proxies[i+1:]...)
+			break
+		}
+	}
+
+	return append([]*Peer(nil), channel.peers...)
+}
+
+// Whether this channel should dial the remote channel advertised with the
+// given service hash. Only the channel with the lower service hash dials so
+// that two channels that discover each other share a single proxy link.
+func (channel *Channel) shouldDial(serviceHash string) bool {
+	return channel.serviceHash < serviceHash
+}
+
+// Whether the remote channel with the given service hash, which is left to
+// dial this channel, has failed to do so. Where discovery only works in one
+// direction the remote channel never sees this channel and so never dials it.
+// A remote channel that does see this channel dials it within a browse period
+// of it being advertised, so it is given two browse periods from when it was
+// first seen. Should both channels dial, addProxy and ServeProxyRequest still
+// keep a single link between them.
+func (channel *Channel) isOverdue(serviceHash string) bool {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	if channel.hasProxyFor(serviceHash) {
+		return false
+	}
+
+	firstSeen, ok := channel.undialed[serviceHash]
+	if !ok {
+		channel.undialed[serviceHash] = time.Now()
+		return false
+	}
+
+	return time.Since(firstSeen) >= 2*channel.service.config.BrowseTimeout
+}
+
+// Whether a proxy connection to the remote channel with the given service
+// hash exists. Must be called with channel.mu held.
+func (channel *Channel) hasProxyFor(serviceHash string) bool {
+	if serviceHash == "" {
+		return false
+	}
+
+	for _, proxy := range channel.proxies {
+		if proxy.Hash_Base64 == serviceHash {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether this channel has a proxy connection to the remote channel with the
+// given service hash
+func (channel *Channel) isLinkedTo(serviceHash string) bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	return channel.hasProxyFor(serviceHash)
+}
+
+// Return the proxy connection accepted from the remote channel with the given
+// service hash, or nil if there is none
+func (channel *Channel) getAcceptedProxy(serviceHash string) *Proxy {
+	if serviceHash == "" {
+		return nil
+	}
+
+	for _, proxy := range channel.getProxies() {
+		if proxy.Hash_Base64 == serviceHash && !proxy.isDialed() {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// Record that this channel is dialing the remote channel with the given
+// service hash. Returns false if it is already dialing or linked to it.
+func (channel *Channel) beginDial(serviceHash string) bool {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	if channel.dialing[serviceHash] || channel.hasProxyFor(serviceHash) {
+		return false
+	}
+
+	channel.dialing[serviceHash] = true
+	return true
+}
+
+// Record that this channel has finished dialing the remote channel with the
+// given service hash
+func (channel *Channel) endDial(serviceHash string) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	delete(channel.dialing, serviceHash)
+}
+
+// Queue a broadcast message for dispatch on this Channel. Messages queued
+// after the channel has been stopped are dropped.
+func (channel *Channel) broadcast(wsBroadcast *WireMessage) {
+	select {
+	case channel.broadcastBuffer <- wsBroadcast:
+	case <-channel.quit:
 	}
 }
 
 // Send service broadcast messages on Channel connections
 func (channel *Channel) messageDispatcher() {
+	defer close(channel.drained)
+
 	for {
 		select {
 		case wsBroadcast, ok := <-channel.broadcastBuffer:
 			if !ok {
 				return
 			}
-			// Send message to local peers
-			channel.localBroadcast(wsBroadcast)
-			// Send message to remote proxies
-			channel.remoteBroadcast(wsBroadcast)
+			channel.dispatch(wsBroadcast)
+		case <-channel.quit:
+			// Deliver any broadcast messages still queued before exiting
+			for {
+				select {
+				case wsBroadcast := <-channel.broadcastBuffer:
+					channel.dispatch(wsBroadcast)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
+func (channel *Channel) dispatch(wsBroadcast *WireMessage) {
+	// Send message to remote proxies (fragments are relayed as they arrive)
+	channel.remoteBroadcast(wsBroadcast)
+
+	// Send message to local peers once all of its fragments have arrived
+	wsBroadcast, err := channel.reassembler.add(wsBroadcast)
+	if err != nil {
+		log.Printf("err: %v", err)
+		return
+	}
+	if wsBroadcast != nil {
+		channel.localBroadcast(wsBroadcast)
+	}
+}
+
 // Broadcast a message to all peer connections for this Channel
 // instance (except to the src websocket connection)
 func (channel *Channel) localBroadcast(broadcast *WireMessage) {
 	// Write to peer connections
-	for _, peer := range channel.peers {
+	for _, peer := range channel.getPeers() {
 		// don't send back to self
 		if peer.id == broadcast.Source {
 			continue
 		}
-		if wireData, err := encodeWireMessage("broadcast", broadcast.Source, "", broadcast.Payload); err == nil {
-			peer.transport.Write(wireData)
-		}
+		peer.transport.writeWireMessage(&WireMessage{
+			Action:  "broadcast",
+			Source:  broadcast.Source,
+			Payload: broadcast.Payload,
+			Binary:  broadcast.Binary,
+		})
 	}
 }
 
 // Broadcast a message to all proxy connections for this Channel
 // instance (except to the src websocket connection)
 func (channel *Channel) remoteBroadcast(broadcast *WireMessage) {
-	// Only send to remote proxies if this message was not received from a proxy itself
+	id, hops := broadcast.Id, broadcast.Hops
+
 	if broadcast.fromProxy {
-		return
+		// Only relay messages received from a proxy in mesh mode
+		if id == "" || !channel.canRelay(hops) {
+			return
+		}
+		hops++
+	} else if channel.isMesh() {
+		// Identify this broadcast so that it is not relayed back to us
+		id = GenerateId()
+		channel.seen.add(broadcast.Source + "/" + id)
 	}
 
 	// Write to proxy connections
-	for _, proxy := range channel.proxies {
-		// don't send back to self
+	for _, proxy := range channel.getProxies() {
+		// don't send back to self or to the proxy it was received from
 		// only write to *writeable* proxy connections
-		if !proxy.writeable || proxy.base.id == broadcast.Source {
+		if !proxy.writeable || proxy.base.id == broadcast.Source || proxy == broadcast.via {
 			continue
 		}
-		if wireData, err := encodeWireMessage("broadcast", broadcast.Source, "", broadcast.Payload); err == nil {
-			proxy.base.transport.Write(wireData)
-		}
+		proxy.getTransport().writeWireMessage(&WireMessage{
+			Action:   "broadcast",
+			Id:       id,
+			Source:   broadcast.Source,
+			Payload:  broadcast.Payload,
+			Fragment: broadcast.Fragment,
+			Binary:   broadcast.Binary,
+			Hops:     hops,
+		})
 	}
 }
 
 // Destroy this Network Web Socket service instance, close all
 // peer and proxy connections.
 func (channel *Channel) Stop() {
-	// Close discovery browser
-	if channel.discoveryService != nil {
-		channel.discoveryService.Shutdown()
+	channel.shutdown(websocket.CloseNormalClosure, "")
+}
+
+// Destroy this Network Web Socket service instance. Queued broadcast messages
+// are delivered and then every peer and proxy connection is sent a close
+// frame with the given code and reason before it is closed.
+func (channel *Channel) shutdown(closeCode int, reason string) {
+	channel.mu.Lock()
+	if channel.closed {
+		channel.mu.Unlock()
+		return
 	}
+	channel.closed = true
+	discoveryService := channel.discoveryService
+	channel.mu.Unlock()
 
-	for _, peer := range channel.peers {
+	// Stop new peers from resolving to this channel
+	channel.service.removeChannel(channel)
+
+	// Unregister this channel from the network
+	if discoveryService != nil {
+		discoveryService.Shutdown()
+	}
+
+	// Release this channel's TLS-SRP credentials. Its proxy path can no longer
+	// be reached now that it has been removed from the service.
+	if err := channel.service.credentials.Release(channel.serviceHash); err != nil {
+		log.Printf("err: %v", err)
+	}
+
+	// Wait for the message dispatcher to drain the broadcast buffer
+	close(channel.quit)
+	<-channel.drained
+
+	for _, peer := range channel.getPeers() {
+		peer.transport.Close(closeCode, reason)
 		peer.Stop()
 	}
 
-	for _, proxy := range channel.proxies {
+	for _, proxy := range channel.getProxies() {
+		proxy.getTransport().Close(closeCode, reason)
 		proxy.Stop()
 	}
 
@@ -1,8 +1,13 @@
 package networkwebsockets
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/richtr/websocket"
@@ -13,62 +18,106 @@ type ClientMessageHandler struct {
 }
 
 func (handler *ClientMessageHandler) Read(buf []byte) error {
-	client := handler.client
-	if client == nil {
-		return errors.New("ClientMessageHandler requires an attached Client object")
+	message, err := decodeWireMessage(buf)
+	if err != nil {
+		return err
 	}
 
-	message, err := decodeWireMessage(buf)
+	return handler.handle(message)
+}
+
+func (handler *ClientMessageHandler) ReadBinary(buf []byte) error {
+	message, err := decodeBinaryWireMessage(buf)
 	if err != nil {
 		return err
 	}
 
+	return handler.handle(message)
+}
+
+func (handler *ClientMessageHandler) handle(message WireMessage) error {
+	client := handler.client
+	if client == nil {
+		return errors.New("ClientMessageHandler requires an attached Client object")
+	}
+
 	switch message.Action {
+	case "broadcast":
 	case "connect":
-		client.Connect <- message
+		if !client.addToRoster(message.Target, message.Metadata) {
+			return nil
+		}
+	case "update":
+		if !client.updateRoster(message.Target, message.Metadata) {
+			return nil
+		}
 	case "disconnect":
-		client.Disconnect <- message
+		client.resolveTarget(message.Target, message)
+		if !client.removeFromRoster(message.Target) {
+			return nil
+		}
 	case "status":
-		client.Status <- message
-	case "broadcast":
-		client.Broadcast <- message
+		client.setId(message.Source)
+		for _, peerId := range client.reconcileRoster(message.Peers) {
+			disconnect := WireMessage{Action: "disconnect", Source: message.Source, Target: peerId}
+			client.resolveTarget(peerId, disconnect)
+			client.enqueue(disconnect)
+		}
 	case "message":
-		client.Message <- message
+		if message.ReplyTo != "" {
+			client.resolve(message.ReplyTo, message)
+			return nil
+		}
+		if message.Request && client.serveRequest(message) {
+			return nil
+		}
+	case "ack", "nack":
+		client.resolve(message.Id, message)
+		return nil
+	case "error":
+		if message.Id != "" {
+			client.resolve(message.Id, message)
+		}
+	default:
+		return nil
 	}
 
+	// Pass message on to this client's callbacks
+	client.enqueue(message)
+
 	return nil
 }
 
 func (handler *ClientMessageHandler) Write(buf []byte) error {
+	return handler.write(websocket.TextMessage, buf)
+}
+
+func (handler *ClientMessageHandler) WriteBinary(buf []byte) error {
+	return handler.write(websocket.BinaryMessage, buf)
+}
+
+func (handler *ClientMessageHandler) write(messageType int, buf []byte) error {
 	client := handler.client
 	if client == nil {
 		return errors.New("ClientMessageHandler requires an attached Client object")
 	}
 
-	if !client.transport.open {
+	transport := client.getTransport()
+	if !transport.isOpen() {
 		return errors.New("Client is not active")
 	}
 
-	client.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	client.transport.conn.WriteMessage(websocket.TextMessage, buf)
-
-	return nil
+	return transport.writeMessage(messageType, buf)
 }
 
+// Connect to a Network Web Socket channel URL. Received messages are delivered
+// on the returned client's channels unless a custom handler is provided.
 func Dial(urlStr string, handler MessageHandler) (*Client, *http.Response, error) {
-	d := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-		ReadBufferSize:   8192,
-		WriteBufferSize:  8192,
-	}
-
-	wsConn, httpResp, err := d.Dial(urlStr, nil)
+	transport, httpResp, err := dialTransport(context.Background(), urlStr, handler)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	transport := NewTransport(wsConn, handler)
-
 	client := NewClient(transport)
 
 	// Setup default client message handler if one has not been provided
@@ -82,50 +131,261 @@ func Dial(urlStr string, handler MessageHandler) (*Client, *http.Response, error
 	return client, httpResp, nil
 }
 
+// Connect to a Network Web Socket channel URL. Received messages are passed
+// to the given callbacks. The connection attempt is abandoned if ctx is done
+// before it completes.
+func DialContext(ctx context.Context, urlStr string, callbacks ClientCallbacks) (*Client, *http.Response, error) {
+	transport, httpResp, err := dialTransport(ctx, urlStr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := newClient(transport, &callbacks)
+	client.transport.handler = &ClientMessageHandler{client}
+
+	// Start read/write pumps
+	client.Start()
+
+	return client, httpResp, nil
+}
+
+// Open a new websocket connection to a Network Web Socket channel URL
+func dialTransport(ctx context.Context, urlStr string, handler MessageHandler) (*Transport, *http.Response, error) {
+	// Close the connection if ctx is done before the handshake completes
+	handshakeDone := make(chan int)
+	defer close(handshakeDone)
+
+	d := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		ReadBufferSize:   DefaultReadBufferSize,
+		WriteBufferSize:  DefaultWriteBufferSize,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-handshakeDone:
+				}
+			}()
+			return conn, nil
+		},
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d.HandshakeTimeout {
+		d.HandshakeTimeout = time.Until(deadline)
+	}
+
+	wsConn, httpResp, err := d.Dial(urlStr, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+
+	if ctx.Err() != nil {
+		wsConn.Close()
+		return nil, nil, ctx.Err()
+	}
+
+	transport := NewTransport(wsConn, handler)
+
+	// Services reassemble fragmented messages before delivering them
+	transport.maxMessageSize = 0
+
+	return transport, httpResp, nil
+}
+
 // Client interface
 
+var (
+	// Returned when a direct message is not acknowledged within the given timeout
+	ErrDeliveryTimeout = errors.New("Timed out waiting for message delivery confirmation")
+
+	// Returned when the target peer disconnects before acknowledging or replying
+	ErrPeerDisconnected = errors.New("Target peer disconnected")
+
+	errClientStopped = errors.New("Client has been stopped")
+)
+
+// Maximum size of each message a Client sends. Leaves room below the default
+// service limits for the source id added when messages are relayed.
+const clientMaxFragmentSize = DefaultMaxMessageSize - 512
+
 type Client struct {
-	// Underlying transport object
+	// Underlying transport object. Replaced when a reconnecting client reconnects.
 	transport *Transport
 
-	// incoming message channels
+	// incoming message channels. Only used by clients created with Dial or
+	// NewClient.
 	Status     chan WireMessage
 	Connect    chan WireMessage
 	Disconnect chan WireMessage
 	Message    chan WireMessage
 	Broadcast  chan WireMessage
+	Update     chan WireMessage
+	Error      chan WireMessage
+
+	// Reconnect and disconnect events of a reconnecting client
+	Events chan ClientEvent
+
+	// Receive incoming messages from the inbox
+	callbacks ClientCallbacks
+
+	// Incoming messages waiting to be passed to callbacks
+	inbox chan WireMessage
+
+	// Guards transport, id, roster, staleRoster, metadata, stopped, buffered,
+	// pending and requestHandler
+	mu sync.Mutex
+
+	// Ids and metadata of the other peers connected to this client's channel
+	roster map[string]*PeerMetadata
+
+	// Ids and metadata of peers known before a reconnect that have not been
+	// seen since
+	staleRoster map[string]*PeerMetadata
+
+	// Metadata this client publishes to its channel, if any
+	metadata *PeerMetadata
+
+	// This client's peer id as last reported by a "status" message
+	id string
+
+	// Whether .Stop() has been called
+	stopped bool
+
+	quit chan int // closed when .Stop() is called
+
+	// Reconnection settings. nil unless created with DialReconnecting.
+	reconnect *ReconnectOptions
+
+	// Broadcasts sent while a reconnecting client is disconnected
+	buffered []*WireMessage
+
+	// Sent messages awaiting a delivery receipt or reply keyed by message id
+	pending map[string]*pendingMessage
+
+	// Serves requests received from other peers
+	requestHandler RequestHandler
+}
+
+// A sent message awaiting a delivery receipt or reply
+type pendingMessage struct {
+	// Id of the peer the message was sent to
+	target string
+
+	// Whether to wait for a reply instead of an "ack"
+	awaitsReply bool
+
+	// Receives the "ack", "nack", reply or "disconnect" message
+	result chan WireMessage
 }
 
+// Create a new Client that delivers incoming messages on its channels
 func NewClient(transport *Transport) *Client {
+	return newClient(transport, nil)
+}
+
+// Create a new Client that passes incoming messages to the given callbacks,
+// or delivers them on its channels if callbacks is nil
+func newClient(transport *Transport, callbacks *ClientCallbacks) *Client {
+	queueSize := DefaultClientQueueSize
+	if callbacks != nil && callbacks.QueueSize > 0 {
+		queueSize = callbacks.QueueSize
+	}
+
 	client := &Client{
 		transport: transport,
 
-		Status:     make(chan WireMessage, 255),
-		Connect:    make(chan WireMessage, 255),
-		Disconnect: make(chan WireMessage, 255),
-		Message:    make(chan WireMessage, 255),
-		Broadcast:  make(chan WireMessage, 255),
+		Status:     make(chan WireMessage, DefaultClientQueueSize),
+		Connect:    make(chan WireMessage, DefaultClientQueueSize),
+		Disconnect: make(chan WireMessage, DefaultClientQueueSize),
+		Message:    make(chan WireMessage, DefaultClientQueueSize),
+		Broadcast:  make(chan WireMessage, DefaultClientQueueSize),
+		Update:     make(chan WireMessage, DefaultClientQueueSize),
+		Error:      make(chan WireMessage, DefaultClientQueueSize),
+
+		Events: make(chan ClientEvent, 16),
+
+		inbox: make(chan WireMessage, queueSize),
+
+		quit: make(chan int),
+
+		roster:      make(map[string]*PeerMetadata),
+		staleRoster: make(map[string]*PeerMetadata),
+
+		pending: make(map[string]*pendingMessage),
 	}
 
+	if callbacks != nil {
+		client.callbacks = *callbacks
+	} else {
+		// Adapt the channel API to callbacks
+		client.callbacks = client.channelCallbacks()
+	}
+
+	go client.runCallbacks()
+
 	return client
 }
 
 func (client *Client) Start() {
 	// Start read/write pumps
-	client.transport.Start()
+	client.getTransport().Start()
 }
 
 func (client *Client) Stop() {
+	client.mu.Lock()
+	if !client.stopped {
+		client.stopped = true
+		close(client.quit)
+	}
+	transport := client.transport
+	client.mu.Unlock()
+
 	// Stop read/write pumps
-	client.transport.Stop()
+	transport.Stop()
+}
+
+// This client's peer id as last reported by a "status" message. Empty until
+// .SendStatusRequest() has been answered.
+func (client *Client) Id() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.id
+}
+
+func (client *Client) setId(id string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.id = id
+}
+
+// Return the current underlying transport object
+func (client *Client) getTransport() *Transport {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.transport
+}
+
+// Number of outbound messages this client has discarded because its send
+// queue was full
+func (client *Client) Dropped() uint64 {
+	return client.getTransport().Dropped()
 }
 
 // Default Client Message Handler Helper functions
 
 func (client *Client) SendBroadcastData(data string) {
-	if wireData, err := encodeWireMessage("broadcast", "", "", data); err == nil {
-		client.transport.Write(wireData)
-	}
+	client.send(&WireMessage{Action: "broadcast", Payload: data})
 }
 
 func (client *Client) SendMessageData(data string, targetId string) {
@@ -133,13 +393,144 @@ func (client *Client) SendMessageData(data string, targetId string) {
 		return
 	}
 
-	if wireData, err := encodeWireMessage("message", "", targetId, data); err == nil {
-		client.transport.Write(wireData)
+	client.send(&WireMessage{Action: "message", Target: targetId, Payload: data})
+}
+
+func (client *Client) SendBroadcastBytes(data []byte) {
+	client.send(&WireMessage{Action: "broadcast", Payload: string(data), Binary: true})
+}
+
+func (client *Client) SendMessageBytes(data []byte, targetId string) {
+	if targetId == "" {
+		return
+	}
+
+	client.send(&WireMessage{Action: "message", Target: targetId, Payload: string(data), Binary: true})
+}
+
+// Send a direct message and wait until its delivery to targetId is confirmed.
+// Returns an error if delivery fails or is not confirmed within timeout.
+func (client *Client) SendMessageDataAndWait(data string, targetId string, timeout time.Duration) error {
+	return client.sendAndWait(&WireMessage{Action: "message", Target: targetId, Payload: data}, timeout)
+}
+
+// Send a binary direct message and wait until its delivery to targetId is
+// confirmed. Returns an error if delivery fails or is not confirmed within timeout.
+func (client *Client) SendMessageBytesAndWait(data []byte, targetId string, timeout time.Duration) error {
+	return client.sendAndWait(&WireMessage{Action: "message", Target: targetId, Payload: string(data), Binary: true}, timeout)
+}
+
+func (client *Client) sendAndWait(message *WireMessage, timeout time.Duration) error {
+	if message.Target == "" {
+		return errors.New("Message must have a target identifier")
+	}
+
+	message.Id = GenerateId()
+
+	pending := client.await(message.Id, message.Target, false)
+	defer client.forget(message.Id)
+
+	client.send(message)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-pending.result:
+		switch r.Action {
+		case "nack":
+			return fmt.Errorf("Message could not be delivered: %s", r.Payload)
+		case "error":
+			return fmt.Errorf("Message could not be delivered: %s", r.Error)
+		case "disconnect":
+			return ErrPeerDisconnected
+		}
+		return nil
+	case <-timer.C:
+		return ErrDeliveryTimeout
+	case <-client.quit:
+		return errClientStopped
+	}
+}
+
+// Register a sent message as awaiting a delivery receipt or reply
+func (client *Client) await(id string, target string, awaitsReply bool) *pendingMessage {
+	pending := &pendingMessage{
+		target:      target,
+		awaitsReply: awaitsReply,
+		result:      make(chan WireMessage, 1),
+	}
+
+	client.mu.Lock()
+	client.pending[id] = pending
+	client.mu.Unlock()
+
+	return pending
+}
+
+// Stop waiting for a delivery receipt or reply to the given message id
+func (client *Client) forget(id string) {
+	client.mu.Lock()
+	delete(client.pending, id)
+	client.mu.Unlock()
+}
+
+// Pass a delivery receipt or reply to the sender waiting for it, if any
+func (client *Client) resolve(id string, message WireMessage) {
+	client.mu.Lock()
+	pending := client.pending[id]
+	if pending == nil || (pending.awaitsReply && message.Action == "ack") {
+		client.mu.Unlock()
+		return
+	}
+	delete(client.pending, id)
+	client.mu.Unlock()
+
+	pending.result <- message
+}
+
+// Pass the given message to every sender waiting on the target peer id
+func (client *Client) resolveTarget(target string, message WireMessage) {
+	var resolved []*pendingMessage
+
+	client.mu.Lock()
+	for id, pending := range client.pending {
+		if pending.target == target {
+			resolved = append(resolved, pending)
+			delete(client.pending, id)
+		}
+	}
+	client.mu.Unlock()
+
+	for _, pending := range resolved {
+		pending.result <- message
+	}
+}
+
+// Write a wire message, splitting it into fragments if it is too large to be
+// sent in a single websocket message
+func (client *Client) send(message *WireMessage) {
+	fragments, err := fragmentWireMessage(message, clientMaxFragmentSize)
+	if err != nil {
+		log.Printf("err: %v", err)
+		return
+	}
+
+	transport := client.getTransport()
+
+	for _, fragment := range fragments {
+		if err := transport.writeWireMessage(fragment); err != nil {
+			// Keep broadcasts for delivery once a reconnecting client reconnects
+			if message.Action == "broadcast" && !transport.isOpen() {
+				client.buffer(message)
+			}
+			return
+		}
 	}
 }
 
 func (client *Client) SendStatusRequest() {
 	if wireData, err := encodeWireMessage("status", "", "", ""); err == nil {
-		client.transport.Write(wireData)
+		client.getTransport().Write(wireData)
 	}
 }
@@ -1,73 +1,1657 @@
 package networkwebsockets
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/richtr/bcrypt"
+	tls "github.com/richtr/go-tls-srp"
+	"github.com/richtr/mdns"
+	"github.com/richtr/websocket"
 )
 
 func createClient(t testing.TB, urlStr string) *Client {
 	client, _, err := Dial(urlStr, nil) // use default ClientMessageHandler
 	if err != nil {
-		t.Fatalf("Dial: ", err)
+		t.Fatalf("Dial: %v", err)
+	}
+	return client
+}
+
+func startService(t testing.TB, host string, port int) *Service {
+	service := NewService(host, port)
+	if service == nil {
+		t.Fatalf("NewService: could not create service on port %d", port)
+	}
+	if _, err := service.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return service
+}
+
+func startServiceWithConfig(t testing.TB, config ServiceConfig) *Service {
+	service, err := NewServiceWithConfig(config)
+	if err != nil {
+		t.Fatalf("NewServiceWithConfig: %v", err)
+	}
+	if _, err := service.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return service
+}
+
+// Create a service that is not started, using the given credentials store (or
+// the default store if nil)
+func newTestService(t testing.TB, credentials CredentialsStore) *Service {
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.CredentialsStore = credentials
+
+	service, err := NewServiceWithConfig(config)
+	if err != nil {
+		t.Fatalf("NewServiceWithConfig: %v", err)
+	}
+	return service
+}
+
+func getClientId(client *Client) string {
+	// Request client's peer id
+	client.SendStatusRequest()
+	// Wait for response
+	message := <-client.Status
+	// Return client's peer id
+	return message.Target
+}
+
+func checkConnect(t testing.TB, message WireMessage, expectedTarget string) {
+	if message.Target != expectedTarget {
+		t.Fatalf("connect=%s, want %s", message.Target, expectedTarget)
+	}
+}
+
+func checkDisconnect(t testing.TB, message WireMessage, expectedTarget string) {
+	if message.Target != expectedTarget {
+		t.Fatalf("disconnect=%s, want %s", message.Target, expectedTarget)
+	}
+}
+
+func checkBroadcast(t testing.TB, payload string, sender *Client, receivers []*Client) {
+	// send broadcast message from sender
+	sender.SendBroadcastData(payload)
+
+	// check broadcast message arrived at all receivers
+	for _, receiver := range receivers {
+		message := <-receiver.Broadcast
+		if message.Payload != payload {
+			t.Fatalf("broadcast=%s, want %s", message.Payload, payload)
+		}
+	}
+}
+
+func checkMessage(t testing.TB, payload string, targetId string, sender *Client, receiver *Client) {
+	if targetId == "" {
+		t.Fatalf("No target identifier provided")
+	}
+
+	// send broadcast message from sender
+	sender.SendMessageData(payload, targetId)
+
+	// check broadcast message arrived at all receivers
+	message := <-receiver.Message
+	if message.Payload != payload {
+		t.Fatalf("message=%s, want %s", message.Payload, payload)
+	}
+}
+
+func checkAcknowledgedMessage(t testing.TB, payload string, targetId string, sender *Client, receiver *Client) {
+	// send direct message from sender and wait for its delivery receipt
+	if err := sender.SendMessageDataAndWait(payload, targetId, 5*time.Second); err != nil {
+		t.Fatalf("SendMessageDataAndWait: %v", err)
+	}
+
+	// check direct message arrived at receiver
+	message := <-receiver.Message
+	if message.Payload != payload || message.Id == "" {
+		t.Fatalf("message=%s (id=%q), want %s with an id", message.Payload, message.Id, payload)
+	}
+}
+
+func checkUnacknowledgedMessage(t testing.TB, targetId string, sender *Client) {
+	if err := sender.SendMessageDataAndWait("undeliverable", targetId, 5*time.Second); err == nil || err == ErrDeliveryTimeout {
+		t.Fatalf("SendMessageDataAndWait: got %v, want a nack", err)
+	}
+}
+
+func checkBinaryBroadcast(t testing.TB, payload []byte, sender *Client, receivers []*Client) {
+	// send binary broadcast message from sender
+	sender.SendBroadcastBytes(payload)
+
+	// check binary broadcast message arrived at all receivers
+	for _, receiver := range receivers {
+		message := <-receiver.Broadcast
+		if !message.Binary || message.Payload != string(payload) {
+			t.Fatalf("binary broadcast=%v (binary=%t), want %v", []byte(message.Payload), message.Binary, payload)
+		}
+	}
+}
+
+func checkBinaryMessage(t testing.TB, payload []byte, targetId string, sender *Client, receiver *Client) {
+	// send binary direct message from sender
+	sender.SendMessageBytes(payload, targetId)
+
+	// check binary direct message arrived at receiver
+	message := <-receiver.Message
+	if !message.Binary || message.Payload != string(payload) {
+		t.Fatalf("binary message=%v (binary=%t), want %v", []byte(message.Payload), message.Binary, payload)
+	}
+}
+
+// TEST CASES
+
+// Text payload larger than the default maximum message size
+func largeTextPayload() string {
+	return strings.Repeat("large \"message\" \u00e9\u263a ", 20000)
+}
+
+// Binary payload larger than the default maximum message size
+func largeBinaryPayload() []byte {
+	payload := make([]byte, 300*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+// Binary payload split into many more fragments than fit in a send queue
+func hugeBinaryPayload() []byte {
+	payload := make([]byte, 4*1024*1024)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestServiceConfigValidation(t *testing.T) {
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 80
+
+	if _, err := NewServiceWithConfig(config); err == nil {
+		t.Fatalf("NewServiceWithConfig accepted invalid port %d", config.Port)
+	}
+
+	config.Port = 21002
+	config.MaxMessageSize = 0
+
+	if _, err := NewServiceWithConfig(config); err == nil {
+		t.Fatalf("NewServiceWithConfig accepted invalid MaxMessageSize %d", config.MaxMessageSize)
+	}
+
+	config.MaxMessageSize = 65536
+	config.PeerRateLimit = RateLimit{MessagesPerSecond: -1}
+
+	if _, err := NewServiceWithConfig(config); err == nil {
+		t.Fatalf("NewServiceWithConfig accepted a negative rate limit")
+	}
+
+	config.PeerRateLimit = RateLimit{}
+	config.ProxyMaxReconnectBackoff = config.ProxyMinReconnectBackoff / 2
+
+	if _, err := NewServiceWithConfig(config); err == nil {
+		t.Fatalf("NewServiceWithConfig accepted a maximum proxy reconnect backoff below the minimum")
+	}
+
+	config.ProxyMaxReconnectBackoff = DefaultProxyMaxReconnectBackoff
+	config.SRPGroup = 0
+
+	if _, err := NewServiceWithConfig(config); err == nil {
+		t.Fatalf("NewServiceWithConfig accepted an unknown SRPGroup")
+	}
+
+	config.SRPGroup = DefaultSRPGroup
+
+	service, err := NewServiceWithConfig(config)
+	if err != nil {
+		t.Fatalf("NewServiceWithConfig: %v", err)
+	}
+	if service.Config().MaxMessageSize != 65536 {
+		t.Fatalf("MaxMessageSize=%d, want %d", service.Config().MaxMessageSize, 65536)
+	}
+
+	// NewService keeps falling back to the default port
+	if service := NewService("localhost", 0); service == nil || service.Port != DefaultPort {
+		t.Fatalf("NewService did not fall back to port %d", DefaultPort)
+	}
+}
+
+func TestServiceStartError(t *testing.T) {
+	service1 := startService(t, "localhost", 21000)
+
+	// Attempt to start a second service on a port that is already in use
+	service2 := NewService("localhost", 21000)
+	if _, err := service2.Start(); err == nil {
+		t.Fatalf("Start succeeded on a port that is already in use")
+	}
+
+	// The failed service can be retried on another port
+	service2.Port = 21001
+	if _, err := service2.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestServiceShutdown(t *testing.T) {
+	service := startService(t, "localhost", 21000)
+
+	client1 := createClient(t, "ws://localhost:21000/testservice0")
+	client2 := createClient(t, "ws://localhost:21000/testservice0")
+
+	client2Id := getClientId(client2)
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := service.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	<-service.StopNotify()
+
+	// All peer connections should have been closed by the service
+	for _, client := range []*Client{client1, client2} {
+		select {
+		case <-client.transport.StopNotify():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client connection was not closed by Shutdown")
+		}
+	}
+}
+
+func TestDiscoveryServiceGoodbye(t *testing.T) {
+	discoveryService := NewDiscoveryService("goodbye", "aGFzaA==", "/goodbye", 21019, 25019)
+	discoveryService.Register("local")
+
+	browse := func() []*mdns.ServiceEntry {
+		entries := make(chan *mdns.ServiceEntry, 16)
+		ipv4Addr, ipv6Addr := mdnsAddrs(25019)
+		if err := mdns.Query(&mdns.QueryParam{Service: "_nws._tcp", Domain: "local", Timeout: 100 * time.Millisecond, Entries: entries, IPv4mdns: ipv4Addr, IPv6mdns: ipv6Addr}); err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		found := []*mdns.ServiceEntry{}
+		for len(entries) > 0 {
+			if entry := <-entries; strings.Contains(entry.Info, "path=/goodbye") {
+				found = append(found, entry)
+			}
+		}
+		return found
+	}
+
+	if entries := browse(); len(entries) != 1 {
+		t.Fatalf("browse found %d records before Shutdown, want 1", len(entries))
+	}
+
+	// The goodbye packet withdraws the PTR, SRV and TXT records
+	packet, err := encodeGoodbyePacket(discoveryService.zone)
+	if err != nil {
+		t.Fatalf("encodeGoodbyePacket: %v", err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	types := []uint16{}
+	for _, record := range msg.Answer {
+		if record.Header().Ttl != 0 {
+			t.Fatalf("record %v has a non-zero TTL", record)
+		}
+		if txt, ok := record.(*dns.TXT); ok && strings.Join(txt.Txt, "") != discoveryService.zone.Info {
+			t.Fatalf("goodbye TXT=%v, want %q", txt.Txt, discoveryService.zone.Info)
+		}
+		types = append(types, record.Header().Rrtype)
+	}
+	if !msg.Response || len(types) != 3 || types[0] != dns.TypePTR || types[1] != dns.TypeSRV || types[2] != dns.TypeTXT {
+		t.Fatalf("goodbye record types=%v, want [PTR SRV TXT]", types)
+	}
+
+	discoveryService.Shutdown()
+
+	if entries := browse(); len(entries) != 0 {
+		t.Fatalf("browse found %d records after Shutdown, want 0", len(entries))
+	}
+}
+
+func TestGenerateId(t *testing.T) {
+	idFormat := regexp.MustCompile("^" + idRegexStr + "$")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := GenerateId()
+		if !idFormat.MatchString(id) {
+			t.Fatalf("GenerateId() = %q, want %s", id, idRegexStr)
+		}
+		if seen[id] {
+			t.Fatalf("GenerateId() repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestPeerIdCollisions(t *testing.T) {
+	service := newTestService(t, nil)
+	channel := newChannel(service, "collisions")
+
+	// Local peers never share an id
+	peer1 := NewPeer(nil)
+	peer2 := NewPeer(nil)
+	peer2.id = peer1.id
+	channel.addPeer(peer1)
+	channel.addPeer(peer2)
+	if peer2.id == peer1.id {
+		t.Fatalf("peer id %q assigned twice", peer1.id)
+	}
+
+	// Remote peers announced with an id in use are ignored
+	proxy := NewProxy(nil, false)
+	proxy.base.channel = channel
+	channel.addProxy(proxy)
+
+	handler := &ProxyMessageHandler{proxy}
+	if err := handler.handle(WireMessage{Action: "connect", Target: peer1.id}); err == nil || proxy.hasPeerId(peer1.id) {
+		t.Fatalf("remote peer with colliding id %q was accepted", peer1.id)
+	}
+	if err := handler.handle(WireMessage{Action: "connect", Target: GenerateId()}); err != nil {
+		t.Fatalf("remote peer with unique id was refused: %v", err)
+	}
+}
+
+func TestChannelCredentials(t *testing.T) {
+
+	service1 := startService(t, "localhost", 21005)
+	service2 := startService(t, "localhost", 21006)
+
+	clientA := createClient(t, "ws://localhost:21005/credentialsA")
+	clientB := createClient(t, "ws://localhost:21005/credentialsB")
+	getClientId(clientA)
+	getClientId(clientB)
+
+	channelA := service1.GetChannelByName("credentialsA")
+	channelB := service1.GetChannelByName("credentialsB")
+
+	credentialsA, _ := service1.credentials.Get(channelA.serviceHash)
+	credentialsB, _ := service1.credentials.Get(channelB.serviceHash)
+	if credentialsA == nil || credentialsB == nil {
+		t.Fatalf("channel credentials were not stored")
+	}
+
+	// Each channel has its own random salt and only its verifier is stored
+	if len(credentialsA.Salt) != srpSaltSize || bytes.Equal(credentialsA.Salt, credentialsB.Salt) {
+		t.Fatalf("channel salts %x and %x are not unique", credentialsA.Salt, credentialsB.Salt)
+	}
+	if !bytes.Equal(credentialsA.Verifier, tls.SRPVerifier(channelA.serviceHash, "credentialsA", credentialsA.Salt, DefaultSRPGroup)) {
+		t.Fatalf("channel credentials do not hold the expected verifier")
+	}
+
+	// Credentials only grant access to their own channel's proxy path
+	if !service1.credentialsAllow(channelA.serviceHash, channelA.proxyPath) {
+		t.Fatalf("channel credentials do not grant access to their own proxy path")
+	}
+	if service1.credentialsAllow(channelA.serviceHash, channelB.proxyPath) {
+		t.Fatalf("channel credentials grant access to another channel's proxy path")
+	}
+
+	// Credentials are owned by each service
+	if c, _ := service2.credentials.Get(channelA.serviceHash); c != nil {
+		t.Fatalf("channel credentials are shared between services")
+	}
+
+	// Credentials are removed when their channel stops
+	clientA.Stop()
+	<-channelA.stopNotify()
+	if c, _ := service1.credentials.Get(channelA.serviceHash); c != nil {
+		t.Fatalf("channel credentials were not removed when the channel stopped")
+	}
+
+	clientB.Stop()
+
+	go service1.Stop()
+	go service2.Stop()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestFileCredentialsStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+
+	newStoreService := func() *Service {
+		store, err := NewFileCredentialsStore(path)
+		if err != nil {
+			t.Fatalf("NewFileCredentialsStore: %v", err)
+		}
+		return newTestService(t, store)
+	}
+
+	service1 := newStoreService()
+	channel1 := newChannel(service1, "private")
+	if err := service1.storeCredentials(channel1); err != nil {
+		t.Fatalf("storeCredentials: %v", err)
+	}
+
+	// The file is only readable by the current user and never holds channel names
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("credentials file was not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("credentials file has mode %v, want 0600", info.Mode().Perm())
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "private") {
+		t.Fatalf("credentials file contains a channel name: %s", data)
+	}
+
+	// A restarted service recognises the channel and reuses its hash and proxy path
+	service2 := newStoreService()
+	channel2 := newChannel(service2, "private")
+	if channel2.serviceHash != channel1.serviceHash || channel2.proxyPath != channel1.proxyPath {
+		t.Fatalf("known channel was not restored from the credentials file")
+	}
+	if other := newChannel(service2, "public"); other.serviceHash == channel1.serviceHash || other.proxyPath == channel1.proxyPath {
+		t.Fatalf("unknown channel reused stored credentials")
+	}
+
+	// Handshakes are only answered for running channels
+	lookup := &srpLookup{service2}
+	if v, _, _, _ := lookup.Lookup(channel2.serviceHash); v != nil {
+		t.Fatalf("verifier returned for a channel that is not running")
+	}
+
+	service2.Channels[channel2.servicePath] = channel2
+	if err := service2.storeCredentials(channel2); err != nil {
+		t.Fatalf("storeCredentials: %v", err)
+	}
+
+	v, s, _, _ := lookup.Lookup(channel2.serviceHash)
+	if v == nil || !bytes.Equal(v, tls.SRPVerifier(channel2.serviceHash, "private", s, DefaultSRPGroup)) {
+		t.Fatalf("stored verifier does not match the channel name")
+	}
+
+	// Credentials are kept in the file when their channel stops...
+	if err := service2.credentials.Release(channel2.serviceHash); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	service3 := newStoreService()
+	if channel3 := newChannel(service3, "private"); channel3.serviceHash != channel1.serviceHash {
+		t.Fatalf("credentials of a stopped channel were not kept in the credentials file")
+	}
+
+	// ...until their channel has not been running for longer than the TTL
+	store := service3.credentials.(*FileCredentialsStore)
+	store.TTL = time.Millisecond
+
+	running := newChannel(service3, "running")
+	stopped := newChannel(service3, "stopped")
+	for _, channel := range []*Channel{running, stopped} {
+		if err := service3.storeCredentials(channel); err != nil {
+			t.Fatalf("storeCredentials: %v", err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := store.Release(stopped.serviceHash); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	if c, _ := store.Get(channel1.serviceHash); c != nil {
+		t.Fatalf("expired credentials were not pruned")
+	}
+	if c, _ := store.Get(running.serviceHash); c == nil {
+		t.Fatalf("credentials of a running channel were pruned")
+	}
+	if c, _ := store.Get(stopped.serviceHash); c == nil {
+		t.Fatalf("credentials of a channel that just stopped were pruned")
+	}
+}
+
+func TestProxyRequestAuthorization(t *testing.T) {
+	service := newTestService(t, nil)
+
+	channelA := newChannel(service, "authorizeA")
+	channelB := newChannel(service, "authorizeB")
+	for _, channel := range []*Channel{channelA, channelB} {
+		service.Channels[channel.servicePath] = channel
+		if err := service.storeCredentials(channel); err != nil {
+			t.Fatalf("storeCredentials: %v", err)
+		}
+	}
+
+	if err := service.authorizeProxyRequest(channelA.serviceHash, channelA); err != nil {
+		t.Fatalf("channel identity refused access to its own proxy path: %v", err)
+	}
+
+	// An identity for one channel cannot reach another channel's proxy path
+	if err := service.authorizeProxyRequest(channelA.serviceHash, channelB); err == nil {
+		t.Fatalf("channel identity was allowed to reach another channel's proxy path")
+	}
+
+	if err := service.authorizeProxyRequest("", channelA); err == nil {
+		t.Fatalf("unauthenticated session was allowed to reach a proxy path")
+	}
+
+	// Proxy requests that were not carried over a TLS-SRP session are refused
+	r := httptest.NewRequest("GET", channelA.proxyPath, nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Protocol", "nws-proxy-draft-01")
+	w := httptest.NewRecorder()
+	service.Handler.ServeProxyRequest(w, r)
+	if w.Code != 403 {
+		t.Fatalf("proxy request without a TLS-SRP session returned %d, want 403", w.Code)
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21007
+	config.OriginPolicy = OriginPolicy{
+		Allow:    []string{"https://*.example.com"},
+		Deny:     []string{"https://evil.example.com"},
+		Channels: map[string][]string{"private": {"https://app.example.com"}},
+		ApproveOrigin: func(origin, channelName string) bool {
+			return origin == "http://approved.test"
+		},
+	}
+
+	service := startServiceWithConfig(t, config)
+
+	tests := []struct {
+		origin  string
+		channel string
+		allowed bool
+	}{
+		{"", "public", true},
+		{"https://www.example.com", "public", true},
+		{"HTTPS://WWW.EXAMPLE.COM", "public", true},
+		{"https://evil.example.com", "public", false},
+		{"https://other.test", "public", false},
+		{"http://approved.test", "public", true},
+		{"https://app.example.com", "private", true},
+		{"https://www.example.com", "private", false},
+		{"http://approved.test", "private", false},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Origin", test.origin)
+		}
+
+		ws, resp, err := websocket.DefaultDialer.Dial("ws://localhost:21007/"+test.channel, header)
+		if (err == nil) != test.allowed {
+			t.Fatalf("origin '%s' joining '%s': allowed = %v, want %v", test.origin, test.channel, err == nil, test.allowed)
+		}
+		if err != nil {
+			if resp == nil || resp.StatusCode != 403 {
+				t.Fatalf("origin '%s' joining '%s' was not refused with 403: %v", test.origin, test.channel, err)
+			}
+			continue
+		}
+
+		// Cross-origin access is only granted to the accepted origin
+		if acao := resp.Header.Get("Access-Control-Allow-Origin"); acao != test.origin {
+			t.Fatalf("Access-Control-Allow-Origin = '%s', want '%s'", acao, test.origin)
+		}
+		ws.Close()
+	}
+
+	go service.Stop()
+	<-service.StopNotify()
+}
+
+func TestLocalRequestAccess(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "nws.sock")
+
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21008
+	config.AllowedHosts = []string{"nws.localhost:21008"}
+	config.UnixSocketPath = socketPath
+
+	service := startServiceWithConfig(t, config)
+
+	// Requests are checked against their remote address, not their Host header
+	addrTests := []struct {
+		remoteAddr string
+		host       string
+		allowed    bool
+	}{
+		{"127.0.0.1:50000", "localhost:21008", true},
+		{"[::1]:50000", "[::1]:21008", true},
+		{"127.0.0.1:50000", "nws.localhost:21008", true},
+		{"192.168.1.20:50000", "localhost:21008", false},
+		{"192.168.1.20:50000", "127.0.0.1:21008", false},
+		{"127.0.0.1:50000", "rebind.example.com:21008", false},
+		{"127.0.0.1:50000", "::1:21008", false},
+	}
+
+	for _, test := range addrTests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Host = test.host
+		if err := service.checkLocalRequest(r); (err == nil) != test.allowed {
+			t.Fatalf("request from %s for host '%s': allowed = %v, want %v", test.remoteAddr, test.host, err == nil, test.allowed)
+		}
+	}
+
+	// A spoofed Host header is refused even over a loopback connection
+	req, _ := http.NewRequest("GET", "http://localhost:21008/", nil)
+	req.Host = "rebind.example.com:21008"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Fatalf("request with spoofed Host returned %d, want 403", resp.StatusCode)
+	}
+
+	// Peers can join channels over the Unix socket
+	info, err := os.Stat(socketPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Unix socket is not restricted to the current user")
+	}
+
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}
+	ws, _, err := dialer.Dial("ws://localhost/unixchannel", nil)
+	if err != nil {
+		t.Fatalf("could not join channel over Unix socket: %v", err)
+	}
+	ws.Close()
+
+	go service.Stop()
+	<-service.StopNotify()
+
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("Unix socket was not removed when the service stopped")
+	}
+}
+
+func TestLocalTokenAuthentication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	tokens, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewTokenStore: %v", err)
+	}
+
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21009
+	config.Tokens = tokens
+
+	service := startServiceWithConfig(t, config)
+
+	chatToken, err := service.IssueToken("chat-app", "chat-*")
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if _, err := service.IssueToken("other-app"); err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+
+	// Tokens are stored in a file only readable by the current user and
+	// survive a restart
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("token file is not restricted to the current user")
+	}
+	if reloaded, err := NewTokenStore(path); err != nil || reloaded.authorize(chatToken, "chat-1") != nil {
+		t.Fatalf("issued token was not persisted")
+	}
+
+	tests := []struct {
+		channel     string
+		header      http.Header
+		allowed     bool
+		subprotocol string
+	}{
+		{"chat-1", http.Header{}, false, ""},
+		{"chat-1", http.Header{"Authorization": {"Bearer invalid"}}, false, ""},
+		{"chat-1", http.Header{"Authorization": {"Bearer " + chatToken}}, true, ""},
+		{"other", http.Header{"Authorization": {"Bearer " + chatToken}}, false, ""},
+		{"chat-1", http.Header{"Authorization": {"bearer " + chatToken}}, true, ""},
+		{"chat-2", http.Header{"Sec-Websocket-Protocol": {tokenSubprotocolPrefix + chatToken + ", chat"}}, true, "chat"},
+		{"chat-2", http.Header{"Sec-Websocket-Protocol": {tokenSubprotocolPrefix + chatToken}}, true, ""},
+	}
+
+	for _, test := range tests {
+		ws, resp, err := websocket.DefaultDialer.Dial("ws://localhost:21009/"+test.channel, test.header)
+		if (err == nil) != test.allowed {
+			t.Fatalf("joining '%s' with %v: allowed = %v, want %v", test.channel, test.header, err == nil, test.allowed)
+		}
+		if err != nil {
+			if resp == nil || resp.StatusCode != 401 {
+				t.Fatalf("joining '%s' was not refused with 401: %v", test.channel, err)
+			}
+			continue
+		}
+
+		// The token subprotocol is never echoed back as the selected subprotocol
+		if selected := resp.Header.Get("Sec-Websocket-Protocol"); selected != test.subprotocol {
+			t.Fatalf("selected subprotocol '%s', want '%s'", selected, test.subprotocol)
+		}
+		ws.Close()
+	}
+
+	// Revoked tokens can no longer join channels
+	tokens.Revoke("chat-app")
+	if err := tokens.authorize(chatToken, "chat-1"); err == nil {
+		t.Fatalf("revoked token was accepted")
+	}
+
+	go service.Stop()
+	<-service.StopNotify()
+}
+
+func TestRateLimits(t *testing.T) {
+	// Delayed messages wait until they are within the limit
+	limiter := newRateLimiter(RateLimit{MessagesPerSecond: 10, MessageBurst: 1})
+	if d := limiter.reserve(0, true); d != 0 {
+		t.Fatalf("first message delayed by %v", d)
+	}
+	if d := limiter.reserve(0, true); d <= 0 || d > 100*time.Millisecond {
+		t.Fatalf("second message delayed by %v, want up to 100ms", d)
+	}
+
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21010
+	config.PeerRateLimit = RateLimit{MessagesPerSecond: 1, MessageBurst: 5}
+	config.RateLimitPolicy = DropThrottledMessage
+
+	service := startServiceWithConfig(t, config)
+
+	client1 := createClient(t, "ws://localhost:21010/ratelimited")
+	client2 := createClient(t, "ws://localhost:21010/ratelimited")
+	checkConnect(t, <-client1.Connect, getClientId(client2))
+
+	for i := 0; i < 20; i++ {
+		client1.SendBroadcastData("flood")
+	}
+
+	// The sender is told its messages were dropped
+	select {
+	case message := <-client1.Error:
+		if !strings.Contains(message.Error, "Rate limit exceeded") {
+			t.Fatalf("unexpected error message: %q", message.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no error message received by throttled sender")
+	}
+
+	// Only the burst reaches the other peer
+	received := 0
+	timeout := time.After(time.Second)
+receive:
+	for {
+		select {
+		case <-client2.Broadcast:
+			received++
+		case <-timeout:
+			break receive
+		}
+	}
+	if received < 5 || received > 6 {
+		t.Fatalf("received %d broadcasts, want 5 or 6", received)
+	}
+
+	// Direct messages awaiting delivery fail when dropped
+	client2Id := getClientId(client2)
+	for i := 0; i < 10; i++ {
+		client1.SendBroadcastData("flood")
+	}
+	if err := client1.SendMessageDataAndWait("flood", client2Id, 5*time.Second); err == nil || !strings.Contains(err.Error(), "Rate limit exceeded") {
+		t.Fatalf("throttled direct message was delivered")
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+	<-service.StopNotify()
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21020
+	config.PeerRateLimit = RateLimit{MessagesPerSecond: 1, MessageBurst: 5}
+	config.RateLimitPolicy = DisconnectThrottledSender
+
+	service := startServiceWithConfig(t, config)
+
+	client := createClient(t, "ws://localhost:21020/ratelimited")
+
+	// The offender never reads so it never answers the close frame it is sent
+	ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:21020/ratelimited", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	message := <-client.Connect
+	offenderId := message.Target
+
+	flood, err := encodeWireMessage("broadcast", "", "", "flood")
+	if err != nil {
+		t.Fatalf("encodeWireMessage: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, flood); err != nil {
+			break
+		}
+	}
+
+	// The offender's connection is stopped and the other peers are told
+	select {
+	case message := <-client.Disconnect:
+		checkDisconnect(t, message, offenderId)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("throttled sender was not disconnected")
+	}
+
+	client.Stop()
+
+	go service.Stop()
+	<-service.StopNotify()
+}
+
+func TestProxyRateLimits(t *testing.T) {
+	services := make([]*Service, 2)
+	for i, port := range []int{21031, 21032} {
+		config := DefaultServiceConfig()
+		config.Host = "localhost"
+		config.Port = port
+		config.DiscoveryPort = port + 4000
+		config.Mesh = true
+		config.ProxyRateLimit = RateLimit{MessagesPerSecond: 1, MessageBurst: 5}
+		config.RateLimitPolicy = DelayThrottledMessage
+		services[i] = startServiceWithConfig(t, config)
+	}
+
+	noisy := createClient(t, "ws://localhost:21031/proxylimited")
+	quiet := createClient(t, "ws://localhost:21031/proxylimited")
+	receiver := createClient(t, "ws://localhost:21032/proxylimited")
+
+	quietId := getClientId(quiet)
+	getClientId(noisy)
+	getClientId(receiver)
+
+	linkChannels(t, services[0].GetChannelByName("proxylimited"), services[1].GetChannelByName("proxylimited"))
+	for i := 0; i < 2; i++ {
+		<-receiver.Connect
+	}
+
+	for i := 0; i < 20; i++ {
+		noisy.SendBroadcastData("flood")
+	}
+	quiet.SendBroadcastData("quiet")
+
+	// Limits apply to each remote peer and never stall the link for the others
+	flooded := 0
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case message := <-receiver.Broadcast:
+			if message.Payload == "flood" {
+				flooded++
+				continue
+			}
+			if message.Source != quietId {
+				t.Fatalf("broadcast %q from %s, want quiet broadcast from %s", message.Payload, message.Source, quietId)
+			}
+		case <-timeout:
+			t.Fatalf("broadcast from a quiet peer was held up by a throttled peer on the same proxy link")
+		}
+		break
+	}
+
+	if flooded > 6 {
+		t.Fatalf("received %d relayed broadcasts from a throttled peer, want at most 6", flooded)
+	}
+
+	noisy.Stop()
+	quiet.Stop()
+	receiver.Stop()
+
+	for _, service := range services {
+		go service.Stop()
+		<-service.StopNotify()
+	}
+}
+
+func TestChannelAdmission(t *testing.T) {
+	var mu sync.Mutex
+	var requests []AdmissionRequest
+
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21011
+	config.ChannelMaxPeers = map[string]int{"limited": 2}
+	config.AdmitPeer = func(request *AdmissionRequest) error {
+		mu.Lock()
+		requests = append(requests, *request)
+		mu.Unlock()
+
+		for _, subprotocol := range request.Subprotocols {
+			if subprotocol == "blocked" {
+				return errors.New("Subprotocol is blocked")
+			}
+		}
+		return nil
+	}
+
+	service := startServiceWithConfig(t, config)
+
+	// The admission hook can veto a join
+	_, resp, err := websocket.DefaultDialer.Dial("ws://localhost:21011/limited", http.Header{"Sec-Websocket-Protocol": {"blocked"}})
+	if err == nil || resp == nil || resp.StatusCode != 403 {
+		t.Fatalf("peer refused by the admission hook was allowed to join")
+	}
+
+	client1 := createClient(t, "ws://localhost:21011/limited")
+	client2 := createClient(t, "ws://localhost:21011/limited")
+	checkConnect(t, <-client1.Connect, getClientId(client2))
+
+	// Channels refuse peers once they are full
+	_, resp, err = websocket.DefaultDialer.Dial("ws://localhost:21011/limited", nil)
+	if err == nil || resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("peer was allowed to join a full channel")
+	}
+
+	// Other channels are not limited
+	client3 := createClient(t, "ws://localhost:21011/unlimited")
+	getClientId(client3)
+
+	mu.Lock()
+	if len(requests) != 4 || requests[0].Channel != "limited" || requests[0].RemoteAddr == "" || requests[2].Peers != 1 {
+		t.Fatalf("unexpected admission requests: %+v", requests)
+	}
+	mu.Unlock()
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go service.Stop()
+	<-service.StopNotify()
+}
+
+func TestChannelAdmissionWithRemotePeers(t *testing.T) {
+	// Only the channel with the lower hash dials, so give the local channel
+	// the lower hash for it to dial the remote channel once it is created
+	hashes := make([]string, 2)
+	for i := range hashes {
+		hash_BCrypt, err := bcrypt.HashBytes([]byte("limited"))
+		if err != nil {
+			t.Fatalf("HashBytes: %v", err)
+		}
+		hashes[i] = base64.StdEncoding.EncodeToString(hash_BCrypt)
+	}
+	if hashes[1] < hashes[0] {
+		hashes[0], hashes[1] = hashes[1], hashes[0]
+	}
+
+	// Create a credentials store from which the "limited" channel reuses hash
+	newStore := func(hash string) CredentialsStore {
+		store := NewMemoryCredentialsStore()
+		credentials, err := NewCredentials(hash, "limited", "/"+GenerateId(), DefaultSRPGroup)
+		if err != nil {
+			t.Fatalf("NewCredentials: %v", err)
+		}
+		credentials.Key = store.ChannelKey("limited")
+		if err := store.Put(hash, credentials); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		return store
+	}
+
+	remoteConfig := DefaultServiceConfig()
+	remoteConfig.Host = "localhost"
+	remoteConfig.Port = 21021
+	remoteConfig.DiscoveryPort = 25021
+	remoteConfig.BrowseTimeout = time.Minute
+	remoteConfig.CredentialsStore = newStore(hashes[1])
+
+	remoteService := startServiceWithConfig(t, remoteConfig)
+
+	remote1 := createClient(t, "ws://localhost:21021/limited")
+	remote2 := createClient(t, "ws://localhost:21021/limited")
+	remote1Id, remote2Id := getClientId(remote1), getClientId(remote2)
+	checkConnect(t, <-remote1.Connect, remote2Id)
+
+	if remoteService.GetChannelByName("limited").serviceHash != hashes[1] {
+		t.Fatalf("remote channel did not reuse its stored hash")
+	}
+
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = 21022
+	config.DiscoveryPort = 25021
+	config.BrowseTimeout = time.Minute
+	config.ChannelMaxPeers = map[string]int{"limited": 2}
+	config.CredentialsStore = newStore(hashes[0])
+
+	service := startServiceWithConfig(t, config)
+
+	// Discover the remote channel before the local channel exists
+	service.getDiscoveryBrowser().Browse(service, 1)
+
+	// The first local peer is admitted before the channel links to the remote
+	// peers that fill it up
+	client := createClient(t, "ws://localhost:21022/limited")
+
+	remoteIds := map[string]bool{remote1Id: true, remote2Id: true}
+	for len(remoteIds) > 0 {
+		select {
+		case message := <-client.Connect:
+			if !remoteIds[message.Target] {
+				t.Fatalf("unexpected connect=%s", message.Target)
+			}
+			delete(remoteIds, message.Target)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("remote peers were not announced to the first local peer")
+		}
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://localhost:21022/limited", nil)
+	if err == nil || resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("peer was allowed to join a channel filled by remote peers")
+	}
+
+	client.Stop()
+	remote1.Stop()
+	remote2.Stop()
+
+	go service.Stop()
+	<-service.StopNotify()
+
+	go remoteService.Stop()
+	<-remoteService.StopNotify()
+}
+
+// Start a mesh mode service that discovers no other services on its own
+func startMeshService(t testing.TB, port int) *Service {
+	config := DefaultServiceConfig()
+	config.Host = "localhost"
+	config.Port = port
+	config.DiscoveryPort = port + 4000
+	config.Mesh = true
+
+	return startServiceWithConfig(t, config)
+}
+
+// Connect two channels with a proxy link, dialing from both sides
+func linkChannels(t testing.TB, a, b *Channel) {
+	for _, pair := range [][2]*Channel{{a, b}, {b, a}} {
+		from, to := pair[0], pair[1]
+		record := &DNSRecord{
+			ServiceEntry: &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: to.service.getProxyPort()},
+			Path:         to.proxyPath,
+			Hash_Base64:  to.serviceHash,
+		}
+		if err := dialProxyFromDNSRecord(record, from); err != nil {
+			t.Fatalf("dialProxyFromDNSRecord: %v", err)
+		}
+	}
+}
+
+func TestMeshRelaying(t *testing.T) {
+	serviceA := startMeshService(t, 21012)
+	serviceB := startMeshService(t, 21013)
+	serviceC := startMeshService(t, 21014)
+
+	clientA := createClient(t, "ws://localhost:21012/mesh")
+	clientB := createClient(t, "ws://localhost:21013/mesh")
+	clientC := createClient(t, "ws://localhost:21014/mesh")
+
+	clientAId := getClientId(clientA)
+	clientBId := getClientId(clientB)
+	clientCId := getClientId(clientC)
+
+	channelA := serviceA.GetChannelByName("mesh")
+	channelB := serviceB.GetChannelByName("mesh")
+	channelC := serviceC.GetChannelByName("mesh")
+
+	// A and C can only reach each other through B
+	linkChannels(t, channelA, channelB)
+	linkChannels(t, channelB, channelC)
+
+	// Wait for the roster of client to hold exactly the given peer ids. The
+	// roster is updated before each connect and disconnect event is queued.
+	roster := func(client *Client, ids ...string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			complete := len(client.Peers()) == len(ids)
+			for _, id := range ids {
+				complete = complete && client.Has(id)
+			}
+			if complete {
+				return
+			}
+
+			select {
+			case <-client.Connect:
+			case <-client.Disconnect:
+			case <-timeout:
+				t.Fatalf("roster=%v, want %v", client.Peers(), ids)
+			}
+		}
+	}
+	roster(clientA, clientBId, clientCId)
+	roster(clientC, clientAId, clientBId)
+
+	// Direct messages and their delivery receipts are routed over B
+	if err := clientA.SendMessageDataAndWait("hello C", clientCId, 5*time.Second); err != nil {
+		t.Fatalf("SendMessageDataAndWait: %v", err)
+	}
+	if message := <-clientC.Message; message.Payload != "hello C" || message.Source != clientAId {
+		t.Fatalf("message=%+v, want 'hello C' from %s", message, clientAId)
+	}
+
+	// Close the loop. Broadcasts are still delivered exactly once.
+	linkChannels(t, channelA, channelC)
+
+	checkBroadcast(t, "hello mesh", clientB, []*Client{clientA, clientC})
+	checkBroadcast(t, "hello again", clientA, []*Client{clientB, clientC})
+
+	select {
+	case message := <-clientC.Broadcast:
+		t.Fatalf("broadcast delivered twice: %+v", message)
+	case message := <-clientA.Broadcast:
+		t.Fatalf("broadcast delivered twice: %+v", message)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Disconnects are relayed to peers more than one hop away
+	clientB.Stop()
+	roster(clientA, clientCId)
+	roster(clientC, clientAId)
+
+	clientA.Stop()
+	clientC.Stop()
+
+	for _, service := range []*Service{serviceA, serviceB, serviceC} {
+		go service.Stop()
+		<-service.StopNotify()
+	}
+}
+
+func TestProxyRelayedMessageSize(t *testing.T) {
+	service1 := startMeshService(t, 21025)
+	service2 := startMeshService(t, 21026)
+
+	// A peer frame at the local size limit that grows when relayed
+	ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:21025/relaysize", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	client := createClient(t, "ws://localhost:21026/relaysize")
+	getClientId(client)
+
+	linkChannels(t, service1.GetChannelByName("relaysize"), service2.GetChannelByName("relaysize"))
+	<-client.Connect
+
+	frame := `{"action":"broadcast","data":""}`
+	payload := strings.Repeat("<", DefaultMaxMessageSize-len(frame))
+	frame = `{"action":"broadcast","data":"` + payload + `"}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	select {
+	case message := <-client.Broadcast:
+		if message.Payload != payload {
+			t.Fatalf("relayed broadcast has a %d byte payload, want %d bytes", len(message.Payload), len(payload))
+		}
+	case message := <-client.Disconnect:
+		t.Fatalf("proxy link was closed by a relayed message: %+v", message)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("broadcast was not relayed")
+	}
+
+	client.Stop()
+
+	for _, service := range []*Service{service1, service2} {
+		go service.Stop()
+		<-service.StopNotify()
+	}
+}
+
+func TestProxyFragmentRelaying(t *testing.T) {
+	service1 := startMeshService(t, 21027)
+	service2 := startMeshService(t, 21028)
+
+	client1 := createClient(t, "ws://localhost:21027/fragments")
+	client2 := createClient(t, "ws://localhost:21028/fragments")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	linkChannels(t, service1.GetChannelByName("fragments"), service2.GetChannelByName("fragments"))
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	// Far more fragments than a send queue holds are relayed over the link
+	// without losing any of them
+	checkBinaryBroadcast(t, hugeBinaryPayload(), client1, []*Client{client2})
+	checkBinaryMessage(t, hugeBinaryPayload(), client1Id, client2, client1)
+
+	client1.Stop()
+	client2.Stop()
+
+	for _, service := range []*Service{service1, service2} {
+		go service.Stop()
+		<-service.StopNotify()
+	}
+}
+
+func TestProxyLinkDeduplication(t *testing.T) {
+	services := make([]*Service, 2)
+	for i, port := range []int{21015, 21016} {
+		config := DefaultServiceConfig()
+		config.Host = "localhost"
+		config.Port = port
+		config.DiscoveryPort = 25015
+		config.BrowseTimeout = time.Second
+		services[i] = startServiceWithConfig(t, config)
+	}
+
+	client1 := createClient(t, "ws://localhost:21015/dedupe")
+	client2 := createClient(t, "ws://localhost:21016/dedupe")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	// Both services discover each other but only one of them dials
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	channel1 := services[0].GetChannelByName("dedupe")
+	channel2 := services[1].GetChannelByName("dedupe")
+
+	if channel1.shouldDial(channel2.serviceHash) == channel2.shouldDial(channel1.serviceHash) {
+		t.Fatalf("both or neither channel would dial the other")
+	}
+
+	// Dialing again from either side does not add another link
+	linkChannels(t, channel1, channel2)
+	for _, service := range services {
+		service.getDiscoveryBrowser().Browse(service, 1)
+	}
+
+	for _, pair := range [][2]*Channel{{channel1, channel2}, {channel2, channel1}} {
+		proxies := pair[0].getProxies()
+		if len(proxies) != 1 || proxies[0].Hash_Base64 != pair[1].serviceHash || !proxies[0].writeable {
+			t.Fatalf("channel has %d proxy links, want a single writeable link to the remote channel", len(proxies))
+		}
+
+		duplicate := NewProxy(nil, true)
+		duplicate.setHash_Base64(pair[1].serviceHash)
+		if _, err := pair[0].addProxy(duplicate); err != errDuplicateProxy {
+			t.Fatalf("addProxy for an already linked channel: got %v, want %v", err, errDuplicateProxy)
+		}
+	}
+
+	// Broadcasts are delivered once in each direction over the single link
+	checkBroadcast(t, "hello once", client1, []*Client{client2})
+	checkBroadcast(t, "hello back", client2, []*Client{client1})
+
+	select {
+	case message := <-client1.Broadcast:
+		t.Fatalf("broadcast delivered twice: %+v", message)
+	case message := <-client2.Broadcast:
+		t.Fatalf("broadcast delivered twice: %+v", message)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	client1.Stop()
+	checkDisconnect(t, <-client2.Disconnect, client1Id)
+	client2.Stop()
+
+	for _, service := range services {
+		go service.Stop()
+		<-service.StopNotify()
 	}
-	return client
 }
 
-func getClientId(client *Client) string {
-	// Request client's peer id
-	client.SendStatusRequest()
-	// Wait for response
-	message := <-client.Status
-	// Return client's peer id
-	return message.Target
-}
+func TestProxyLinkOneWayDiscovery(t *testing.T) {
+	service1 := startMeshService(t, 21023)
+	service2 := startMeshService(t, 21024)
 
-func checkConnect(t testing.TB, message WireMessage, expectedTarget string) {
-	if message.Target != expectedTarget {
-		t.Fatalf("connect=%s, want %s", message.Target, expectedTarget)
+	client1 := createClient(t, "ws://localhost:21023/oneway")
+	client2 := createClient(t, "ws://localhost:21024/oneway")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	channel1 := service1.GetChannelByName("oneway")
+	channel2 := service2.GetChannelByName("oneway")
+
+	// Only the channel that is left to be dialed discovers the other
+	lower, higher := channel1, channel2
+	if !lower.shouldDial(higher.serviceHash) {
+		lower, higher = higher, lower
+	}
+	record := &DNSRecord{
+		ServiceEntry: &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: lower.service.getProxyPort()},
+		Path:         lower.proxyPath,
+		Hash_Base64:  lower.serviceHash,
+	}
+
+	// The remote channel is given time to dial first
+	if err := dialProxyFromDNSRecord(record, higher); err != nil {
+		t.Fatalf("dialProxyFromDNSRecord: %v", err)
+	}
+	if higher.isLinkedTo(lower.serviceHash) {
+		t.Fatalf("channel dialed a remote channel expected to dial it")
+	}
+
+	// After two browse periods without an inbound link it dials anyway
+	higher.mu.Lock()
+	higher.undialed[lower.serviceHash] = time.Now().Add(-2 * higher.service.config.BrowseTimeout)
+	higher.mu.Unlock()
+
+	if err := dialProxyFromDNSRecord(record, higher); err != nil {
+		t.Fatalf("dialProxyFromDNSRecord: %v", err)
+	}
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	if len(channel1.getProxies()) != 1 || len(channel2.getProxies()) != 1 {
+		t.Fatalf("channels are not joined by a single proxy link")
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	for _, service := range []*Service{service1, service2} {
+		go service.Stop()
+		<-service.StopNotify()
 	}
 }
 
-func checkDisconnect(t testing.TB, message WireMessage, expectedTarget string) {
-	if message.Target != expectedTarget {
-		t.Fatalf("disconnect=%s, want %s", message.Target, expectedTarget)
+func TestProxyLinkReconnection(t *testing.T) {
+	services := make([]*Service, 2)
+	for i, port := range []int{21017, 21018} {
+		config := DefaultServiceConfig()
+		config.Host = "localhost"
+		config.Port = port
+		config.DiscoveryPort = 25017
+		config.BrowseTimeout = time.Second
+		config.ProxyMinReconnectBackoff = 200 * time.Millisecond
+		config.ProxyMaxReconnectBackoff = 400 * time.Millisecond
+		services[i] = startServiceWithConfig(t, config)
+	}
+
+	clients := []*Client{
+		createClient(t, "ws://localhost:21017/relink"),
+		createClient(t, "ws://localhost:21018/relink"),
+	}
+	ids := []string{getClientId(clients[0]), getClientId(clients[1])}
+
+	checkConnect(t, <-clients[0].Connect, ids[1])
+	checkConnect(t, <-clients[1].Connect, ids[0])
+
+	channels := []*Channel{services[0].GetChannelByName("relink"), services[1].GetChannelByName("relink")}
+
+	dialer, remote := 0, 1
+	if !channels[0].shouldDial(channels[1].serviceHash) {
+		dialer, remote = 1, 0
+	}
+
+	proxies := channels[dialer].Proxies()
+	if len(proxies) != 1 || proxies[0].State() != ProxyConnected {
+		t.Fatalf("dialing channel has %d proxy links, want a single connected link", len(proxies))
+	}
+	proxy := proxies[0]
+
+	// Drop the link without sending any disconnect messages. Both ends tell
+	// their local peers that the remote peer has gone.
+	proxy.getTransport().conn.Close()
+
+	checkDisconnect(t, <-clients[dialer].Disconnect, ids[remote])
+	checkDisconnect(t, <-clients[remote].Disconnect, ids[dialer])
+
+	if state := proxy.State(); state != ProxyRetrying {
+		t.Fatalf("state=%d, want ProxyRetrying", state)
+	}
+
+	// The dialing end re-dials the same link and both ends re-sync
+	checkConnect(t, <-clients[dialer].Connect, ids[remote])
+	checkConnect(t, <-clients[remote].Connect, ids[dialer])
+
+	if proxies := channels[dialer].Proxies(); len(proxies) != 1 || proxies[0] != proxy || proxy.State() != ProxyConnected {
+		t.Fatalf("link was not re-established in place (state=%d)", proxy.State())
+	}
+
+	checkBroadcast(t, "hello again", clients[remote], []*Client{clients[dialer]})
+	checkMessage(t, "welcome back", ids[remote], clients[dialer], clients[remote])
+
+	// A link to a channel that is no longer advertised is abandoned
+	go services[remote].Stop()
+	<-services[remote].StopNotify()
+
+	checkDisconnect(t, <-clients[dialer].Disconnect, ids[remote])
+
+	select {
+	case <-proxy.StopNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("link to a channel that is no longer advertised was not abandoned")
+	}
+	if proxy.State() != ProxyFailed || len(channels[dialer].Proxies()) != 0 {
+		t.Fatalf("state=%d with %d proxy links, want an abandoned link", proxy.State(), len(channels[dialer].Proxies()))
+	}
+
+	for _, client := range clients {
+		client.Stop()
 	}
+
+	go services[dialer].Stop()
+	<-services[dialer].StopNotify()
 }
 
-func checkBroadcast(t testing.TB, payload string, sender *Client, receivers []*Client) {
-	// send broadcast message from sender
-	sender.SendBroadcastData(payload)
+func TestProxyLinkHalfOpenReconnection(t *testing.T) {
+	services := make([]*Service, 2)
+	for i, port := range []int{21033, 21034} {
+		config := DefaultServiceConfig()
+		config.Host = "localhost"
+		config.Port = port
+		config.DiscoveryPort = 25033
+		config.BrowseTimeout = time.Minute // only browse when asked to below
+		config.ProxyMinReconnectBackoff = 200 * time.Millisecond
+		config.ProxyMaxReconnectBackoff = 400 * time.Millisecond
+		services[i] = startServiceWithConfig(t, config)
+	}
 
-	// check broadcast message arrived at all receivers
-	for _, receiver := range receivers {
-		message := <-receiver.Broadcast
-		if message.Payload != payload {
-			t.Fatalf("broadcast=%s, want %s", message.Payload, payload)
+	clients := []*Client{
+		createClient(t, "ws://localhost:21033/halfopen"),
+		createClient(t, "ws://localhost:21034/halfopen"),
+	}
+	ids := []string{getClientId(clients[0]), getClientId(clients[1])}
+
+	channels := []*Channel{services[0].GetChannelByName("halfopen"), services[1].GetChannelByName("halfopen")}
+
+	dialer, remote := 0, 1
+	if !channels[0].shouldDial(channels[1].serviceHash) {
+		dialer, remote = 1, 0
+	}
+
+	// Relay the link over a TCP connection that can be cut at one end only
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer relay.Close()
+
+	dialerConns := make(chan net.Conn, 1)
+	remoteConns := make(chan net.Conn, 1)
+	go func() {
+		dialerConn, err := relay.Accept()
+		if err != nil {
+			return
 		}
+		remoteConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", services[remote].getProxyPort()))
+		if err != nil {
+			dialerConn.Close()
+			return
+		}
+		dialerConns <- dialerConn
+		remoteConns <- remoteConn
+
+		go io.Copy(remoteConn, dialerConn)
+		io.Copy(dialerConn, remoteConn)
+	}()
+
+	record := &DNSRecord{
+		ServiceEntry: &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: relay.Addr().(*net.TCPAddr).Port},
+		Path:         channels[remote].proxyPath,
+		Hash_Base64:  channels[remote].serviceHash,
+	}
+	if err := dialProxyFromDNSRecord(record, channels[dialer]); err != nil {
+		t.Fatalf("dialProxyFromDNSRecord: %v", err)
 	}
-}
 
-func checkMessage(t testing.TB, payload string, targetId string, sender *Client, receiver *Client) {
-	if targetId == "" {
-		t.Fatalf("No target identifier provided")
+	checkConnect(t, <-clients[dialer].Connect, ids[remote])
+	checkConnect(t, <-clients[remote].Connect, ids[dialer])
+
+	// Learn the address the remote channel advertises to re-dial it directly
+	services[dialer].getDiscoveryBrowser().Browse(services[dialer], 1)
+
+	proxy := channels[dialer].Proxies()[0]
+
+	// Drop the dialing end of the TCP connection only. The remote end is left
+	// half-open and still holds the link it accepted.
+	dialerConn, remoteConn := <-dialerConns, <-remoteConns
+	defer remoteConn.Close()
+	dialerConn.Close()
+
+	checkDisconnect(t, <-clients[dialer].Disconnect, ids[remote])
+
+	// The re-dialed link replaces the stale link at the remote end
+	for _, i := range []int{dialer, remote} {
+		other := ids[dialer+remote-i]
+		timeout := time.After(10 * time.Second)
+	reconnected:
+		for {
+			select {
+			case message := <-clients[i].Connect:
+				checkConnect(t, message, other)
+				break reconnected
+			case message := <-clients[i].Disconnect:
+				checkDisconnect(t, message, other)
+			case <-timeout:
+				t.Fatalf("link was not re-established while the remote end held a stale link")
+			}
+		}
 	}
 
-	// send broadcast message from sender
-	sender.SendMessageData(payload, targetId)
+	if proxy.State() != ProxyConnected || len(channels[remote].Proxies()) != 1 {
+		t.Fatalf("state=%d with %d remote proxy links, want a single connected link", proxy.State(), len(channels[remote].Proxies()))
+	}
 
-	// check broadcast message arrived at all receivers
-	message := <-receiver.Message
-	if message.Payload != payload {
-		t.Fatalf("message=%s, want %s", message.Payload, payload)
+	checkBroadcast(t, "hello again", clients[remote], []*Client{clients[dialer]})
+	checkMessage(t, "welcome back", ids[remote], clients[dialer], clients[remote])
+
+	for _, client := range clients {
+		client.Stop()
+	}
+
+	for _, service := range services {
+		go service.Stop()
+		<-service.StopNotify()
 	}
 }
 
-// TEST CASES
+func TestSlowConsumerPolicy(t *testing.T) {
+	newQueuedTransport := func(policy SlowConsumerPolicy) *Transport {
+		config := DefaultServiceConfig()
+		config.SendQueueSize = 2
+		config.SlowConsumerPolicy = policy
+
+		transport := NewTransport(nil, nil)
+		transport.configure(&config, config.MaxMessageSize)
+		transport.open = true // queue messages without starting the pumps
+		return transport
+	}
+
+	queued := func(transport *Transport) string {
+		var messages []string
+		for len(transport.send) > 0 {
+			messages = append(messages, string((<-transport.send).data))
+		}
+		return strings.Join(messages, ",")
+	}
+
+	for _, policy := range []SlowConsumerPolicy{DropOldestMessage, DropNewestMessage, DisconnectSlowConsumer} {
+		transport := newQueuedTransport(policy)
+		for _, message := range []string{"1", "2", "3"} {
+			transport.writeMessage(websocket.TextMessage, []byte(message))
+		}
+
+		if transport.Dropped() != 1 {
+			t.Errorf("Policy %d: expected 1 dropped message, got %d", policy, transport.Dropped())
+		}
+
+		expected := map[SlowConsumerPolicy]string{DropOldestMessage: "2,3", DropNewestMessage: "1,2", DisconnectSlowConsumer: "1,2"}[policy]
+		if got := queued(transport); got != expected {
+			t.Errorf("Policy %d: expected queued messages %q, got %q", policy, expected, got)
+		}
+
+		if transport.isOpen() != (policy != DisconnectSlowConsumer) {
+			t.Errorf("Policy %d: unexpected transport open state %v", policy, transport.isOpen())
+		}
+	}
+}
 
 func TestSameProxyClients(t *testing.T) {
 
-	service := NewService("localhost", 21000)
-	service.Start()
+	service := startService(t, "localhost", 21000)
 
 	// Create new Network Web Socket channel peers
 	client1 := createClient(t, "ws://localhost:21000/testservice1")
@@ -100,6 +1684,19 @@ func TestSameProxyClients(t *testing.T) {
 	checkMessage(t, "direct message 5", client1Id, client3, client1)
 	checkMessage(t, "direct message 6", client2Id, client3, client2)
 
+	// Test binary messaging
+	checkBinaryBroadcast(t, []byte{0x00, 0x01, 0xfe, 0xff}, client1, []*Client{client2, client3})
+	checkBinaryMessage(t, []byte{0xde, 0xad, 0xbe, 0xef}, client3Id, client2, client3)
+
+	// Test acknowledged messaging
+	checkAcknowledgedMessage(t, "acknowledged message 1", client2Id, client1, client2)
+	checkUnacknowledgedMessage(t, "unknown-peer", client1)
+
+	// Test fragmented messaging
+	checkBroadcast(t, largeTextPayload(), client1, []*Client{client2, client3})
+	checkBinaryMessage(t, largeBinaryPayload(), client1Id, client3, client1)
+	checkBinaryBroadcast(t, hugeBinaryPayload(), client2, []*Client{client1, client3})
+
 	// Test disconnect messaging
 
 	client1.Stop()
@@ -116,16 +1713,350 @@ func TestSameProxyClients(t *testing.T) {
 	<-service.StopNotify()
 }
 
+func TestClientRequests(t *testing.T) {
+
+	service := startService(t, "localhost", 21002)
+
+	requester := createClient(t, "ws://localhost:21002/testservice3")
+	responder := createClient(t, "ws://localhost:21002/testservice3")
+
+	requesterId := getClientId(requester)
+	responderId := getClientId(responder)
+
+	checkConnect(t, <-requester.Connect, responderId)
+	checkConnect(t, <-responder.Connect, requesterId)
+
+	blocked := make(chan int, 1)
+	release := make(chan int)
+	responder.HandleRequests(func(request WireMessage) (string, error) {
+		switch request.Payload {
+		case "fail":
+			return "", errors.New("request failed")
+		case "block":
+			blocked <- 1
+			<-release
+		}
+		return "reply to " + request.Payload, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Test replies
+	if reply, err := requester.Request(ctx, responderId, "ping"); err != nil || reply != "reply to ping" {
+		t.Fatalf("Request: got (%q, %v), want (%q, nil)", reply, err, "reply to ping")
+	}
+
+	// Test handler errors
+	if _, err := requester.Request(ctx, responderId, "fail"); err == nil || err.Error() != "request failed" {
+		t.Fatalf("Request: got %v, want request failed", err)
+	}
+
+	// Test unknown targets
+	if _, err := requester.Request(ctx, "unknown-peer", "ping"); err != ErrUnknownTarget {
+		t.Fatalf("Request: got %v, want %v", err, ErrUnknownTarget)
+	}
+
+	// Test timeouts
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+	if _, err := requester.Request(shortCtx, responderId, "block"); err != context.DeadlineExceeded {
+		t.Fatalf("Request: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	<-blocked
+	release <- 1
+
+	// Test peer disconnects
+	go func() {
+		<-blocked
+		responder.Stop()
+	}()
+	if _, err := requester.Request(ctx, responderId, "block"); err != ErrPeerDisconnected {
+		t.Fatalf("Request: got %v, want %v", err, ErrPeerDisconnected)
+	}
+	close(release)
+
+	requester.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestReconnectingClient(t *testing.T) {
+
+	service := startService(t, "localhost", 21003)
+
+	client, _, err := DialReconnecting("ws://localhost:21003/testservice4", nil, ReconnectOptions{
+		MinBackoff:       time.Second,
+		MaxBackoff:       2 * time.Second,
+		BufferBroadcasts: 4,
+	})
+	if err != nil {
+		t.Fatalf("DialReconnecting: %v", err)
+	}
+
+	clientId := getClientId(client)
+
+	departed := createClient(t, "ws://localhost:21003/testservice4")
+	departedId := getClientId(departed)
+
+	checkConnect(t, <-client.Connect, departedId)
+	if !client.Has(departedId) {
+		t.Fatalf("client roster=%v, want %s", client.Peers(), departedId)
+	}
+
+	// Restart the service underneath the client
+	service.Stop()
+
+	if event := <-client.Events; event.Type != ClientDisconnected {
+		t.Fatalf("event=%d, want ClientDisconnected", event.Type)
+	}
+
+	// Broadcasts sent while disconnected are buffered
+	client.SendBroadcastData("buffered broadcast")
+
+	service = startService(t, "localhost", 21003)
+
+	observer := createClient(t, "ws://localhost:21003/testservice4")
+	observerId := getClientId(observer)
+
+	for event := range client.Events {
+		if event.Type == ClientReconnected {
+			break
+		}
+		if event.Type != ClientReconnectFailed {
+			t.Fatalf("event=%d, want ClientReconnected", event.Type)
+		}
+	}
+
+	// The client re-issues a status request to learn its new peer id
+	newClientId := (<-client.Status).Source
+	if newClientId == "" || newClientId == clientId || client.Id() != newClientId {
+		t.Fatalf("client id=%q after reconnecting, want a new id (was %q)", newClientId, clientId)
+	}
+
+	checkConnect(t, <-observer.Connect, newClientId)
+
+	// Peers that left during the outage are removed from the roster
+	if client.Has(departedId) {
+		t.Fatalf("client roster=%v still has %s after reconnecting", client.Peers(), departedId)
+	}
+
+	checkConnect(t, <-client.Connect, observerId)
+	if peers := client.Peers(); len(peers) != 1 || peers[0] != observerId {
+		t.Fatalf("client roster=%v, want [%s]", peers, observerId)
+	}
+
+	message := <-observer.Broadcast
+	if message.Payload != "buffered broadcast" || message.Source != newClientId {
+		t.Fatalf("broadcast=%q from %q, want buffered broadcast from %q", message.Payload, message.Source, newClientId)
+	}
+
+	client.Stop()
+	observer.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestReconnectingClientRequeue(t *testing.T) {
+
+	service := startService(t, "localhost", 21029)
+
+	client, _, err := DialReconnecting("ws://localhost:21029/testservice-requeue", nil, ReconnectOptions{
+		BufferBroadcasts: 4,
+	})
+	if err != nil {
+		t.Fatalf("DialReconnecting: %v", err)
+	}
+
+	broadcast, _ := encodeWireMessage("broadcast", "", "", "queued broadcast")
+
+	direct := &WireMessage{Action: "message", Id: GenerateId(), Target: "peer", Payload: "queued message"}
+	directData, _ := marshalWireMessage(direct)
+	pending := client.await(direct.Id, direct.Target, false)
+
+	// Only the last fragment of this broadcast was still queued
+	partial := &WireMessage{
+		Action:   "broadcast",
+		Payload:  "tail",
+		Fragment: &WireFragment{Id: GenerateId(), Index: 1, Count: 2},
+	}
+	partialData, _ := marshalWireMessage(partial)
+
+	client.requeue([]outboundMessage{
+		{websocket.TextMessage, broadcast},
+		{websocket.TextMessage, directData},
+		{websocket.TextMessage, partialData},
+	})
+
+	client.mu.Lock()
+	buffered := client.buffered
+	client.mu.Unlock()
+
+	if len(buffered) != 1 || buffered[0].Payload != "queued broadcast" {
+		t.Fatalf("buffered=%v, want only the queued broadcast", buffered)
+	}
+
+	select {
+	case result := <-pending.result:
+		if result.Action != "nack" {
+			t.Fatalf("direct message result=%q, want nack", result.Action)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sender of the queued direct message was not notified")
+	}
+
+	client.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestClientCallbacks(t *testing.T) {
+
+	service := startService(t, "localhost", 21004)
+
+	// Dialing with a cancelled context fails
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := DialContext(cancelledCtx, "ws://localhost:21004/testservice5", ClientCallbacks{}); err != context.Canceled {
+		t.Fatalf("DialContext: got %v, want %v", err, context.Canceled)
+	}
+
+	connected := make(chan WireMessage, 1)
+	broadcasts := make(chan WireMessage, 1)
+
+	client1, _, err := DialContext(context.Background(), "ws://localhost:21004/testservice5", ClientCallbacks{
+		OnConnect:   func(message WireMessage) { connected <- message },
+		OnBroadcast: func(message WireMessage) { broadcasts <- message },
+	})
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+
+	client2 := createClient(t, "ws://localhost:21004/testservice5")
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-connected, client2Id)
+
+	// An unread channel does not hold up delivery on the others
+	for i := 0; i < DefaultClientQueueSize+10; i++ {
+		client2.SendStatusRequest()
+	}
+
+	client2.SendBroadcastData("hello callbacks")
+	if message := <-broadcasts; message.Payload != "hello callbacks" {
+		t.Fatalf("broadcast=%s, want hello callbacks", message.Payload)
+	}
+
+	client1.SendBroadcastData("hello channels")
+	if message := <-client2.Broadcast; message.Payload != "hello channels" {
+		t.Fatalf("broadcast=%s, want hello channels", message.Payload)
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestConcurrentClients(t *testing.T) {
+	service := startService(t, "localhost", 21030)
+
+	const numClients = 10
+	const numBroadcasts = 10
+
+	// Join the same channel from many goroutines at once
+	clients := make([]*Client, numClients)
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, _, err := Dial("ws://localhost:21030/concurrentservice1", nil)
+			if err != nil {
+				t.Errorf("Dial: %v", err)
+				return
+			}
+			getClientId(client)
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// Wait for every client to learn about every other client
+	for _, client := range clients {
+		for i := 0; i < numClients-1; i++ {
+			<-client.Connect
+		}
+	}
+
+	// Broadcast from all clients at once
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			for i := 0; i < numBroadcasts; i++ {
+				client.SendBroadcastData("concurrent broadcast")
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		for i := 0; i < (numClients-1)*numBroadcasts; i++ {
+			message := <-client.Broadcast
+			if message.Payload != "concurrent broadcast" {
+				t.Fatalf("broadcast=%s, want %s", message.Payload, "concurrent broadcast")
+			}
+		}
+	}
+
+	// Leave the channel from all clients at once while other channels are
+	// being created and destroyed
+	for _, client := range clients {
+		wg.Add(2)
+		go func(client *Client) {
+			defer wg.Done()
+			client.Stop()
+		}(client)
+		go func() {
+			defer wg.Done()
+			client, _, err := Dial("ws://localhost:21030/concurrentservice2", nil)
+			if err != nil {
+				t.Errorf("Dial: %v", err)
+				return
+			}
+			getClientId(client)
+			client.Stop()
+		}()
+	}
+	wg.Wait()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
 func TestMultipleProxyClients(t *testing.T) {
 
-	service1 := NewService("localhost", 21000)
-	service1.Start()
+	service1 := startService(t, "localhost", 21000)
 
-	service2 := NewService("localhost", 21001)
-	service2.Start()
+	service2 := startService(t, "localhost", 21001)
 
 	// Create new Network Web Socket channel peers
-	client1 := createClient(t, "ws://localhost:21000/testservice2")
+	client1 := createClient(t, "ws://localhost:21000/testservice2?name=one&app=test&capabilities=chat,video")
 	client2 := createClient(t, "ws://localhost:21001/testservice2")
 	client3 := createClient(t, "ws://localhost:21001/testservice2")
 
@@ -144,6 +2075,27 @@ func TestMultipleProxyClients(t *testing.T) {
 	checkConnect(t, <-client3.Connect, client2Id)
 	checkConnect(t, <-client3.Connect, client1Id)
 
+	// Test roster tracking of remote peers
+	if !client1.Has(client2Id) || !client1.Has(client3Id) || len(client1.Peers()) != 2 {
+		t.Fatalf("client1 roster=%v, want [%s %s]", client1.Peers(), client2Id, client3Id)
+	}
+
+	// Test peer metadata published on join and updated later
+	if metadata, _ := client2.PeerMetadata(client1Id); metadata.Name != "one" || metadata.App != "test" || len(metadata.Capabilities) != 2 {
+		t.Fatalf("client1 metadata=%+v, want name one, app test and 2 capabilities", metadata)
+	}
+
+	client1.SetMetadata(PeerMetadata{Name: "uno"})
+	for _, receiver := range []*Client{client2, client3} {
+		update := <-receiver.Update
+		if update.Target != client1Id || update.Metadata == nil || update.Metadata.Name != "uno" {
+			t.Fatalf("update=%+v, want name uno for %s", update, client1Id)
+		}
+		if metadata, _ := receiver.PeerMetadata(client1Id); metadata.Name != "uno" {
+			t.Fatalf("client1 metadata=%+v, want name uno", metadata)
+		}
+	}
+
 	// Test broadcast messaging
 	checkBroadcast(t, "hello world 1", client1, []*Client{client2, client3})
 	checkBroadcast(t, "hello world 2", client2, []*Client{client1, client3})
@@ -157,6 +2109,29 @@ func TestMultipleProxyClients(t *testing.T) {
 	checkMessage(t, "direct message 5", client1Id, client3, client1)
 	checkMessage(t, "direct message 6", client2Id, client3, client2)
 
+	// Test binary messaging across proxies
+	checkBinaryBroadcast(t, []byte{0x00, 0x01, 0xfe, 0xff}, client2, []*Client{client1, client3})
+	checkBinaryMessage(t, []byte{0xde, 0xad, 0xbe, 0xef}, client1Id, client3, client1)
+
+	// Test acknowledged messaging
+	checkAcknowledgedMessage(t, "acknowledged message 1", client1Id, client2, client1)
+	checkAcknowledgedMessage(t, "acknowledged message 2", client3Id, client1, client3)
+
+	// Test request messaging
+	client3.HandleRequests(func(request WireMessage) (string, error) {
+		return "reply to " + request.Payload, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if reply, err := client1.Request(ctx, client3Id, "ping"); err != nil || reply != "reply to ping" {
+		t.Fatalf("Request: got (%q, %v), want (%q, nil)", reply, err, "reply to ping")
+	}
+	client3.HandleRequests(nil)
+
+	// Test fragmented messaging
+	checkBinaryBroadcast(t, largeBinaryPayload(), client1, []*Client{client2, client3})
+	checkMessage(t, largeTextPayload(), client2Id, client3, client2)
+
 	// Test disconnect messaging
 	client1.Stop()
 	checkDisconnect(t, <-client2.Disconnect, client1Id)
@@ -179,8 +2154,7 @@ func TestMultipleProxyClients(t *testing.T) {
 // BENCHMARKS
 
 func BenchmarkSameProxyClientSetup(b *testing.B) {
-	service := NewService("localhost", 21000)
-	service.Start()
+	service := startService(b, "localhost", 21000)
 
 	b.ResetTimer() // start benchmark timer
 
@@ -200,8 +2174,7 @@ func BenchmarkSameProxyClientSetup(b *testing.B) {
 }
 
 func BenchmarkSameProxyClientMessaging(b *testing.B) {
-	service := NewService("localhost", 21000)
-	_ = service.Start()
+	service := startService(b, "localhost", 21000)
 
 	client1 := createClient(b, "ws://localhost:21000/benchmarkservice2")
 	client2 := createClient(b, "ws://localhost:21000/benchmarkservice2")
@@ -228,8 +2201,7 @@ func BenchmarkSameProxyClientMessaging(b *testing.B) {
 }
 
 func BenchmarkSameProxyClientBroadcast(b *testing.B) {
-	service := NewService("localhost", 21000)
-	service.Start()
+	service := startService(b, "localhost", 21000)
 
 	client1 := createClient(b, "ws://localhost:21000/benchmarkservice3")
 	client2 := createClient(b, "ws://localhost:21000/benchmarkservice3")
@@ -254,11 +2226,9 @@ func BenchmarkSameProxyClientBroadcast(b *testing.B) {
 }
 
 func BenchmarkDifferentProxyClientBroadcast(b *testing.B) {
-	service1 := NewService("localhost", 21000)
-	service1.Start()
+	service1 := startService(b, "localhost", 21000)
 
-	service2 := NewService("localhost", 21001)
-	service2.Start()
+	service2 := startService(b, "localhost", 21001)
 
 	client1 := createClient(b, "ws://localhost:21000/benchmarkservice4")
 	client2 := createClient(b, "ws://localhost:21001/benchmarkservice4")
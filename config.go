@@ -0,0 +1,319 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	tls "github.com/richtr/go-tls-srp"
+)
+
+const (
+	// Default port on which the localhost Network Web Socket endpoint is served.
+	DefaultPort = 9009
+
+	// Default time allowed to write a message to any websocket.
+	DefaultWriteWait = 10 * time.Second
+
+	// Default time allowed to read the next pong message from any websocket.
+	DefaultPongWait = 60 * time.Second
+
+	// Default maximum message size allowed from any websocket.
+	DefaultMaxMessageSize = 8192
+
+	// Default maximum message size allowed from TLS-SRP proxy websockets.
+	// Relayed peer messages gain the fields added by proxies and their
+	// payloads can grow up to six times when JSON escaped again.
+	DefaultProxyMaxMessageSize = 8 * DefaultMaxMessageSize
+
+	// Default maximum size of a payload reassembled from fragmented messages.
+	DefaultMaxReassembledMessageSize = 16 * 1024 * 1024
+
+	// Default time allowed to receive all the fragments of a payload.
+	DefaultReassemblyTimeout = 30 * time.Second
+
+	// Default number of outbound messages queued for each websocket.
+	DefaultSendQueueSize = 256
+
+	// Default websocket read and write buffer sizes.
+	DefaultReadBufferSize  = 8192
+	DefaultWriteBufferSize = 8192
+
+	// Default multicast port for mDNS/DNS-SD discovery (standard mDNS port is 5353)
+	DefaultDiscoveryPort = 5406
+
+	// Default duration of each mDNS/DNS-SD browse pass.
+	DefaultBrowseTimeout = 10 * time.Second
+
+	// Default delays before the first and between later attempts to
+	// re-establish a lost proxy link.
+	DefaultProxyMinReconnectBackoff = DefaultMinReconnectBackoff
+	DefaultProxyMaxReconnectBackoff = DefaultMaxReconnectBackoff
+
+	// Default maximum number of proxy hops a message is relayed over in mesh mode.
+	DefaultMeshMaxHops = 8
+
+	// Default SRP group used in TLS-SRP proxy handshakes.
+	DefaultSRPGroup = tls.SRPGroup4096
+)
+
+// SlowConsumerPolicy determines what happens when a message is written to a
+// websocket whose outbound queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// Discard the oldest queued message to make room for the new message.
+	DropOldestMessage SlowConsumerPolicy = iota
+
+	// Discard the new message.
+	DropNewestMessage
+
+	// Discard the new message and close the websocket connection.
+	DisconnectSlowConsumer
+)
+
+// ServiceConfig holds all the tunable parameters of a Service. Each Service
+// keeps its own copy so multiple services in the same process can run with
+// different limits.
+type ServiceConfig struct {
+	// Host name advertised for this service. Defaults to the device hostname.
+	Host string
+
+	// Port on which the localhost endpoint is served.
+	Port int
+
+	// Time allowed to write a message to any websocket.
+	WriteWait time.Duration
+
+	// Time allowed to read the next pong message from any websocket.
+	// Pings are sent at 9/10 of this period.
+	PongWait time.Duration
+
+	// Additional Host header values (e.g. "myapp.localhost:9009") accepted by
+	// the localhost endpoint. Requests naming any other host are refused to
+	// guard against DNS rebinding.
+	AllowedHosts []string
+
+	// Path of a Unix domain socket on which the localhost endpoint is also
+	// served. Empty to serve only on the loopback TCP port.
+	UnixSocketPath string
+
+	// Maximum message size allowed from local peer websockets.
+	MaxMessageSize int64
+
+	// Maximum message size allowed from TLS-SRP proxy websockets. Must leave
+	// room for relayed messages of up to MaxMessageSize from local peers.
+	ProxyMaxMessageSize int64
+
+	// Maximum size of a payload reassembled from fragmented messages.
+	MaxReassembledMessageSize int64
+
+	// Time allowed to receive all the fragments of a payload.
+	ReassemblyTimeout time.Duration
+
+	// Number of outbound messages queued for each websocket.
+	SendQueueSize int
+
+	// What to do when a websocket's outbound queue is full.
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// Limits on the messages accepted from each local peer websocket, from
+	// each remote peer relaying over a TLS-SRP proxy websocket and by each
+	// channel as a whole. Disabled by default.
+	PeerRateLimit    RateLimit
+	ProxyRateLimit   RateLimit
+	ChannelRateLimit RateLimit
+
+	// What to do with messages that exceed a rate limit.
+	RateLimitPolicy RateLimitPolicy
+
+	// Websocket read and write buffer sizes.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Multicast port used for mDNS/DNS-SD discovery.
+	DiscoveryPort int
+
+	// Duration of each mDNS/DNS-SD browse pass.
+	BrowseTimeout time.Duration
+
+	// Delay before the first attempt to re-establish a lost proxy link that
+	// this service dialed. Doubled after each failed attempt up to
+	// ProxyMaxReconnectBackoff. Each delay is randomly reduced by up to half.
+	ProxyMinReconnectBackoff time.Duration
+	ProxyMaxReconnectBackoff time.Duration
+
+	// Number of failed attempts after which a lost proxy link is abandoned.
+	// Zero means a lost proxy link is retried for as long as the remote
+	// channel is advertised.
+	ProxyMaxReconnectAttempts int
+
+	// Whether channels relay broadcasts, direct messages and peer
+	// announcements between their proxy connections so that services that
+	// cannot discover each other directly still form one channel.
+	Mesh bool
+
+	// Maximum number of proxy hops a message is relayed over in mesh mode.
+	MeshMaxHops int
+
+	// SRP group used in TLS-SRP proxy handshakes.
+	SRPGroup tls.SRPGroup
+
+	// Maximum number of peers (local and remote) in each channel. Zero for no limit.
+	// The limit is only applied when a local peer joins. Remote peers announced
+	// over proxy connections are never refused, so they can take a channel
+	// over its limit.
+	MaxPeers int
+
+	// Maximum number of peers in specific channels, keyed by channel name.
+	// Overrides MaxPeers.
+	ChannelMaxPeers map[string]int
+
+	// Called before a local peer joins a channel. Returning an error refuses
+	// the peer.
+	AdmitPeer func(request *AdmissionRequest) error
+
+	// Web page origins that may join channels through the localhost endpoint.
+	// By default every origin may join.
+	OriginPolicy OriginPolicy
+
+	// Bearer tokens that local applications must present to join channels
+	// through the localhost endpoint. Nil to disable token authentication.
+	Tokens *TokenStore
+
+	// Storage for the TLS-SRP credentials of this service's channels.
+	// Defaults to a MemoryCredentialsStore.
+	CredentialsStore CredentialsStore
+}
+
+// DefaultServiceConfig returns a ServiceConfig populated with default values.
+func DefaultServiceConfig() ServiceConfig {
+	return ServiceConfig{
+		Port: DefaultPort,
+
+		WriteWait:      DefaultWriteWait,
+		PongWait:       DefaultPongWait,
+		MaxMessageSize: DefaultMaxMessageSize,
+
+		ProxyMaxMessageSize:       DefaultProxyMaxMessageSize,
+		MaxReassembledMessageSize: DefaultMaxReassembledMessageSize,
+		ReassemblyTimeout:         DefaultReassemblyTimeout,
+
+		SendQueueSize:      DefaultSendQueueSize,
+		SlowConsumerPolicy: DropOldestMessage,
+
+		ReadBufferSize:  DefaultReadBufferSize,
+		WriteBufferSize: DefaultWriteBufferSize,
+
+		DiscoveryPort: DefaultDiscoveryPort,
+		BrowseTimeout: DefaultBrowseTimeout,
+
+		ProxyMinReconnectBackoff: DefaultProxyMinReconnectBackoff,
+		ProxyMaxReconnectBackoff: DefaultProxyMaxReconnectBackoff,
+
+		MeshMaxHops: DefaultMeshMaxHops,
+
+		SRPGroup: DefaultSRPGroup,
+	}
+}
+
+// Validate checks that all values in this ServiceConfig are usable.
+func (config *ServiceConfig) Validate() error {
+	if config.Port <= 1024 || config.Port >= 65534 {
+		return fmt.Errorf("Port must be between 1025 and 65533 (got %d)", config.Port)
+	}
+
+	if config.WriteWait <= 0 {
+		return errors.New("WriteWait must be greater than zero")
+	}
+
+	if config.PongWait <= 0 {
+		return errors.New("PongWait must be greater than zero")
+	}
+
+	if config.MaxMessageSize <= 0 || config.ProxyMaxMessageSize <= 0 {
+		return errors.New("MaxMessageSize and ProxyMaxMessageSize must be greater than zero")
+	}
+
+	if config.MaxReassembledMessageSize <= 0 {
+		return errors.New("MaxReassembledMessageSize must be greater than zero")
+	}
+
+	if config.ReassemblyTimeout <= 0 {
+		return errors.New("ReassemblyTimeout must be greater than zero")
+	}
+
+	if config.SendQueueSize <= 0 {
+		return errors.New("SendQueueSize must be greater than zero")
+	}
+
+	if config.SlowConsumerPolicy < DropOldestMessage || config.SlowConsumerPolicy > DisconnectSlowConsumer {
+		return fmt.Errorf("Unknown SlowConsumerPolicy %d", config.SlowConsumerPolicy)
+	}
+
+	for _, limit := range []RateLimit{config.PeerRateLimit, config.ProxyRateLimit, config.ChannelRateLimit} {
+		if err := limit.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.RateLimitPolicy < DropThrottledMessage || config.RateLimitPolicy > DisconnectThrottledSender {
+		return fmt.Errorf("Unknown RateLimitPolicy %d", config.RateLimitPolicy)
+	}
+
+	if config.MaxPeers < 0 {
+		return errors.New("MaxPeers must not be negative")
+	}
+
+	for channelName, maxPeers := range config.ChannelMaxPeers {
+		if maxPeers < 0 {
+			return fmt.Errorf("MaxPeers of the '%s' channel must not be negative", channelName)
+		}
+	}
+
+	if config.ProxyMinReconnectBackoff <= 0 || config.ProxyMaxReconnectBackoff < config.ProxyMinReconnectBackoff {
+		return errors.New("ProxyMinReconnectBackoff must be greater than zero and no greater than ProxyMaxReconnectBackoff")
+	}
+
+	if config.ProxyMaxReconnectAttempts < 0 {
+		return errors.New("ProxyMaxReconnectAttempts must not be negative")
+	}
+
+	if config.Mesh && config.MeshMaxHops <= 0 {
+		return errors.New("MeshMaxHops must be greater than zero")
+	}
+
+	if config.ReadBufferSize <= 0 || config.WriteBufferSize <= 0 {
+		return errors.New("ReadBufferSize and WriteBufferSize must be greater than zero")
+	}
+
+	if config.DiscoveryPort <= 0 || config.DiscoveryPort > 65535 {
+		return fmt.Errorf("DiscoveryPort must be between 1 and 65535 (got %d)", config.DiscoveryPort)
+	}
+
+	if config.BrowseTimeout < time.Second {
+		return errors.New("BrowseTimeout must be at least one second")
+	}
+
+	if config.SRPGroup < tls.SRPGroup1024 || config.SRPGroup > tls.SRPGroup8192 {
+		return fmt.Errorf("Unknown SRPGroup %d", config.SRPGroup)
+	}
+
+	return nil
+}
+
+// Resolve the host name to advertise if one has not been provided
+func (config *ServiceConfig) resolveHost() error {
+	if config.Host != "" {
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Could not determine device hostname: %v", err)
+	}
+	config.Host = hostname
+
+	return nil
+}
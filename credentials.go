@@ -0,0 +1,442 @@
+package networkwebsockets
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	tls "github.com/richtr/go-tls-srp"
+)
+
+const (
+	// Size in bytes of the random salt generated for each channel's TLS-SRP credentials
+	srpSaltSize = 16
+
+	// Size in bytes of the secret each credentials store keys channel names with
+	channelKeySecretSize = 32
+
+	// Default time for which a FileCredentialsStore keeps the credentials of
+	// channels that are no longer running
+	DefaultCredentialsTTL = 30 * 24 * time.Hour
+)
+
+// Context key under which the TLS-SRP connection of a proxy request is stored
+type proxyConnContextKeyType struct{}
+
+var proxyConnContextKey = proxyConnContextKeyType{}
+
+// Return the SRP username authenticated by the TLS-SRP connection that carried
+// the given proxy request, or an empty string if there is none
+func proxyRequestSRPUser(r *http.Request) string {
+	conn, ok := r.Context().Value(proxyConnContextKey).(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := conn.ConnectionState()
+	if !state.HandshakeComplete {
+		return ""
+	}
+
+	return state.SRPUser
+}
+
+// Credentials are the TLS-SRP verifier and salt granting access to a single
+// channel's proxy path. The channel name they were derived from is not kept.
+type Credentials struct {
+	Verifier []byte       `json:"verifier"`
+	Salt     []byte       `json:"salt"`
+	Group    tls.SRPGroup `json:"group"`
+
+	// Proxy path of the channel these credentials grant access to
+	ProxyPath string `json:"proxyPath"`
+
+	// Key of the channel name these credentials were created for (see
+	// CredentialsStore.ChannelKey)
+	Key string `json:"key"`
+
+	// When the channel using these credentials last started or stopped
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// Derive new credentials with a random salt for the given SRP username and
+// password that grant access to the channel at proxyPath
+func NewCredentials(user, password, proxyPath string, group tls.SRPGroup) (*Credentials, error) {
+	salt := make([]byte, srpSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.New("Could not generate TLS-SRP salt")
+	}
+
+	return &Credentials{
+		Verifier:  tls.SRPVerifier(user, password, salt, group),
+		Salt:      salt,
+		Group:     group,
+		ProxyPath: proxyPath,
+	}, nil
+}
+
+// CredentialsStore holds the TLS-SRP credentials of the channels of a Service
+// keyed by SRP username (the channel's base64 bcrypt hash)
+type CredentialsStore interface {
+	// Return the credentials stored for the given username or nil if there are none
+	Get(user string) (*Credentials, error)
+
+	// Store credentials for the given username
+	Put(user string, credentials *Credentials) error
+
+	// Called when the channel using the given username stops. Stores that do
+	// not keep credentials across restarts should delete them.
+	Release(user string) error
+
+	// Return the key identifying credentials created for the given channel
+	// name. Keys must not reveal channel names.
+	ChannelKey(serviceName string) string
+
+	// Return the usernames of all stored credentials with the given key
+	Find(key string) ([]string, error)
+}
+
+/** In-memory credentials storage **/
+
+// MemoryCredentialsStore keeps credentials only while their channel is running.
+// It is the default CredentialsStore of a Service.
+type MemoryCredentialsStore struct {
+	mu      sync.RWMutex
+	entries map[string]*Credentials
+
+	// Random secret that channel names are keyed with
+	secret []byte
+}
+
+func NewMemoryCredentialsStore() *MemoryCredentialsStore {
+	secret := make([]byte, channelKeySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("err: %v", err)
+	}
+
+	return &MemoryCredentialsStore{
+		entries: make(map[string]*Credentials),
+		secret:  secret,
+	}
+}
+
+func (store *MemoryCredentialsStore) Get(user string) (*Credentials, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	credentials, ok := store.entries[user]
+	if !ok {
+		return nil, nil
+	}
+
+	c := *credentials
+	return &c, nil
+}
+
+func (store *MemoryCredentialsStore) Put(user string, credentials *Credentials) error {
+	if credentials == nil {
+		return errors.New("Credentials must not be nil")
+	}
+
+	c := *credentials
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.entries[user] = &c
+
+	return nil
+}
+
+func (store *MemoryCredentialsStore) Release(user string) error {
+	return store.Delete(user)
+}
+
+// Delete the credentials stored for the given username
+func (store *MemoryCredentialsStore) Delete(user string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.entries, user)
+
+	return nil
+}
+
+// Channel names are keyed with an HMAC-SHA256 of the store's secret so that
+// they can be matched quickly without being stored
+func (store *MemoryCredentialsStore) ChannelKey(serviceName string) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	mac := hmac.New(sha256.New, store.secret)
+	mac.Write([]byte(serviceName))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (store *MemoryCredentialsStore) Find(key string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	users := []string{}
+	for user, credentials := range store.entries {
+		if credentials.Key == key {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+/** File-backed credentials storage **/
+
+// FileCredentialsStore keeps credentials in a JSON file readable only by the
+// current user so that known private channels keep the same hash, proxy path
+// and verifier across restarts. Channel names are never written to the file.
+type FileCredentialsStore struct {
+	MemoryCredentialsStore
+
+	path string
+
+	// How long the credentials of channels that are no longer running are
+	// kept. Defaults to DefaultCredentialsTTL and must be set before use.
+	TTL time.Duration
+
+	// Usernames of the running channels using stored credentials
+	active map[string]bool
+
+	// Serializes writes to the file
+	fileMu sync.Mutex
+}
+
+// Contents of a credentials file
+type credentialsFile struct {
+	Secret      []byte                  `json:"secret"`
+	Credentials map[string]*Credentials `json:"credentials"`
+}
+
+// Open the credentials file at path, creating it when credentials are first stored
+func NewFileCredentialsStore(path string) (*FileCredentialsStore, error) {
+	store := &FileCredentialsStore{
+		MemoryCredentialsStore: *NewMemoryCredentialsStore(),
+		path:                   path,
+		TTL:                    DefaultCredentialsTTL,
+		active:                 make(map[string]bool),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read credentials file: %v", err)
+	}
+
+	var file credentialsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Could not parse credentials file: %v", err)
+	}
+	if len(file.Secret) != channelKeySecretSize {
+		return nil, errors.New("Could not parse credentials file: invalid secret")
+	}
+
+	store.secret = file.Secret
+	if file.Credentials != nil {
+		store.entries = file.Credentials
+	}
+
+	store.prune(time.Now())
+
+	return store, nil
+}
+
+// Credentials that are stored are in use until they are released
+func (store *FileCredentialsStore) Put(user string, credentials *Credentials) error {
+	if credentials == nil {
+		return errors.New("Credentials must not be nil")
+	}
+
+	c := *credentials
+	c.LastUsed = time.Now()
+
+	if err := store.MemoryCredentialsStore.Put(user, &c); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	store.active[user] = true
+	store.mu.Unlock()
+
+	return store.save()
+}
+
+// Credentials stored in a file are kept when their channel stops, until their
+// channel has not been running for longer than the store's TTL
+func (store *FileCredentialsStore) Release(user string) error {
+	now := time.Now()
+
+	store.mu.Lock()
+	delete(store.active, user)
+	if credentials, ok := store.entries[user]; ok {
+		credentials.LastUsed = now
+	}
+	store.prune(now)
+	store.mu.Unlock()
+
+	return store.save()
+}
+
+// Delete the credentials stored for the given username so that its channel is
+// no longer recognised after a restart
+func (store *FileCredentialsStore) Delete(user string) error {
+	store.MemoryCredentialsStore.Delete(user)
+
+	store.mu.Lock()
+	delete(store.active, user)
+	store.mu.Unlock()
+
+	return store.save()
+}
+
+// Delete the credentials of channels that are not running and were last used
+// longer than the store's TTL ago. Must be called with mu held.
+func (store *FileCredentialsStore) prune(now time.Time) {
+	for user, credentials := range store.entries {
+		if !store.active[user] && now.Sub(credentials.LastUsed) > store.TTL {
+			delete(store.entries, user)
+		}
+	}
+}
+
+// Atomically replace the credentials file with the current entries
+func (store *FileCredentialsStore) save() error {
+	store.fileMu.Lock()
+	defer store.fileMu.Unlock()
+
+	store.mu.RLock()
+	data, err := json.Marshal(credentialsFile{
+		Secret:      store.secret,
+		Credentials: store.entries,
+	})
+	store.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("Could not write credentials file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Could not write credentials file: %v", err)
+	}
+
+	return nil
+}
+
+/** Service credentials management **/
+
+// Find stored credentials that were created for a channel with the given name
+// and are not in use by a running channel. Returns the username and proxy path
+// to reuse or empty strings if there are none.
+func (service *Service) findStoredCredentials(serviceName string) (string, string) {
+	users, err := service.credentials.Find(service.credentials.ChannelKey(serviceName))
+	if err != nil {
+		log.Printf("err: %v", err)
+		return "", ""
+	}
+
+	for _, user := range users {
+		if service.getChannelByHash(user) != nil {
+			continue
+		}
+
+		credentials, err := service.credentials.Get(user)
+		if err != nil || credentials == nil {
+			continue
+		}
+
+		return user, credentials.ProxyPath
+	}
+
+	return "", ""
+}
+
+// Store TLS-SRP credentials granting access to the given channel's proxy path,
+// reusing stored credentials that still match the channel. Stored credentials
+// are in use until the channel releases them.
+func (service *Service) storeCredentials(channel *Channel) error {
+	credentials, err := service.credentials.Get(channel.serviceHash)
+	if err != nil {
+		return err
+	}
+
+	if credentials == nil || credentials.ProxyPath != channel.proxyPath || credentials.Group != service.config.SRPGroup {
+		credentials, err = NewCredentials(channel.serviceHash, channel.serviceName, channel.proxyPath, service.config.SRPGroup)
+		if err != nil {
+			return err
+		}
+	}
+
+	credentials.Key = service.credentials.ChannelKey(channel.serviceName)
+
+	return service.credentials.Put(channel.serviceHash, credentials)
+}
+
+// Whether the credentials stored for the given username grant access to proxyPath
+func (service *Service) credentialsAllow(user, proxyPath string) bool {
+	credentials, err := service.credentials.Get(user)
+
+	return err == nil && credentials != nil && credentials.ProxyPath == proxyPath
+}
+
+// Check that a TLS-SRP session authenticated as user was established for the
+// given channel and may therefore reach its proxy path
+func (service *Service) authorizeProxyRequest(user string, channel *Channel) error {
+	if user == "" {
+		return errors.New("No TLS-SRP identity was authenticated")
+	}
+
+	if user != channel.serviceHash {
+		return errors.New("TLS-SRP identity does not belong to the requested channel")
+	}
+
+	if !service.credentialsAllow(user, channel.proxyPath) {
+		return errors.New("TLS-SRP credentials do not grant access to the requested proxy path")
+	}
+
+	return nil
+}
+
+// Resolves TLS-SRP usernames to the stored credentials of a Service's running channels
+type srpLookup struct {
+	service *Service
+}
+
+func (l *srpLookup) Lookup(user string) (v, s []byte, grp tls.SRPGroup, err error) {
+	service := l.service
+	grp = service.config.SRPGroup
+
+	// Only channels that are running can be reached
+	if service.getChannelByHash(user) == nil {
+		return nil, nil, grp, nil
+	}
+
+	credentials, err := service.credentials.Get(user)
+	if err != nil || credentials == nil || credentials.Group != grp {
+		return nil, nil, grp, err
+	}
+
+	return credentials.Verifier, credentials.Salt, credentials.Group, nil
+}
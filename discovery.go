@@ -7,8 +7,10 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/richtr/bcrypt"
 	"github.com/richtr/mdns"
 )
@@ -16,19 +18,20 @@ import (
 const (
 	ipv4mdns = "224.0.0.251"
 	ipv6mdns = "ff02::fb"
-	mdnsPort = 5406 // operate on our own multicast port (standard mDNS port is 5353)
 )
 
-var (
-	network_ipv4Addr = &net.UDPAddr{
+// Build the IPv4 and IPv6 multicast addresses for the given mDNS port
+func mdnsAddrs(port int) (*net.UDPAddr, *net.UDPAddr) {
+	network_ipv4Addr := &net.UDPAddr{
 		IP:   net.ParseIP(ipv4mdns),
-		Port: mdnsPort,
+		Port: port,
 	}
-	network_ipv6Addr = &net.UDPAddr{
+	network_ipv6Addr := &net.UDPAddr{
 		IP:   net.ParseIP(ipv6mdns),
-		Port: mdnsPort,
+		Port: port,
 	}
-)
+	return network_ipv4Addr, network_ipv6Addr
+}
 
 /** Network Web Socket DNS-SD Discovery Client interface **/
 
@@ -38,15 +41,22 @@ type DiscoveryService struct {
 	Path string
 	Port int
 
+	// Multicast port on which this service is advertised
+	DiscoveryPort int
+
+	// DNS zone advertised by server
+	zone   *mdns.MDNSService
 	server *mdns.Server
 }
 
-func NewDiscoveryService(name, hash, path string, port int) *DiscoveryService {
+func NewDiscoveryService(name, hash, path string, port, discoveryPort int) *DiscoveryService {
 	discoveryService := &DiscoveryService{
 		Name: name,
 		Hash: hash,
 		Path: path,
 		Port: port,
+
+		DiscoveryPort: discoveryPort,
 	}
 
 	return discoveryService
@@ -70,6 +80,8 @@ func (dc *DiscoveryService) Register(domain string) {
 
 	var mdnsClientConfig *mdns.Config
 
+	network_ipv4Addr, network_ipv6Addr := mdnsAddrs(dc.DiscoveryPort)
+
 	// Advertise service to the correct endpoint (local or network)
 	mdnsClientConfig = &mdns.Config{
 		IPv4Addr: network_ipv4Addr,
@@ -86,34 +98,104 @@ func (dc *DiscoveryService) Register(domain string) {
 		return
 	}
 
+	dc.zone = s
 	dc.server = serv
 
 	log.Printf("New '%s' channel advertised as '%s' in %s network", dc.Name, fmt.Sprintf("%s._nws._tcp", dnssdServiceId), domain)
 }
 
+// Unregister this service from the network with mDNS goodbye packets and
+// stop advertising it
 func (dc *DiscoveryService) Shutdown() {
 	if dc.server != nil {
+		dc.sendGoodbye()
 		dc.server.Shutdown()
 	}
 }
 
+// Announce to the network that the records of this service are no longer valid
+func (dc *DiscoveryService) sendGoodbye() {
+	packet, err := encodeGoodbyePacket(dc.zone)
+	if err != nil {
+		log.Printf("err: %v", err)
+		return
+	}
+
+	network_ipv4Addr, network_ipv6Addr := mdnsAddrs(dc.DiscoveryPort)
+
+	// Either address family may be unavailable on this host
+	for _, addr := range []*net.UDPAddr{network_ipv4Addr, network_ipv6Addr} {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			continue
+		}
+		conn.Write(packet)
+		conn.Close()
+	}
+}
+
+/** mDNS goodbye packets **/
+
+// Build an unsolicited mDNS response that withdraws the PTR, SRV and TXT
+// records of the given zone by announcing them with a TTL of zero
+func encodeGoodbyePacket(zone *mdns.MDNSService) ([]byte, error) {
+	serviceAddr := fmt.Sprintf("%s.%s.", strings.Trim(zone.Service, "."), strings.Trim(zone.Domain, "."))
+
+	// The zone answers the PTR record of its service with the SRV and TXT
+	// records of its instance
+	records := zone.Records(dns.Question{Name: serviceAddr, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	if len(records) == 0 {
+		return nil, fmt.Errorf("No DNS records to withdraw for '%s'", serviceAddr)
+	}
+
+	msg := &dns.Msg{
+		MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+		Compress: true,
+	}
+	for _, record := range records {
+		record.Header().Ttl = 0
+		msg.Answer = append(msg.Answer, record)
+	}
+
+	return msg.Pack()
+}
+
 /** Network Web Socket DNS-SD Discovery Server interface **/
 
 type DiscoveryBrowser struct {
+	// Guards cachedDNSRecords, advertisedDNSRecords, lastAdvertisedDNSRecords and closed
+	mu sync.Mutex
+
 	// Network Web Socket DNS-SD records currently unresolved by this proxy instance
 	cachedDNSRecords map[string]*DNSRecord
 	closed           bool
+
+	// Network Web Socket DNS-SD records of other services seen during the
+	// current and the last completed browse
+	advertisedDNSRecords     map[string]*DNSRecord
+	lastAdvertisedDNSRecords map[string]*DNSRecord
+
+	// Multicast port on which to browse for services
+	discoveryPort int
 }
 
-func NewDiscoveryBrowser() *DiscoveryBrowser {
+func NewDiscoveryBrowser(discoveryPort int) *DiscoveryBrowser {
 	discoveryBrowser := &DiscoveryBrowser{
 		cachedDNSRecords: make(map[string]*DNSRecord, 255),
 		closed:           false,
+
+		advertisedDNSRecords:     make(map[string]*DNSRecord),
+		lastAdvertisedDNSRecords: make(map[string]*DNSRecord),
+
+		discoveryPort: discoveryPort,
 	}
 
 	return discoveryBrowser
 }
 
+// Browse for other services' channels for timeoutSeconds, dialing the ones
+// that resolve to our channels and caching the others. Returns once every
+// response has been handled.
 func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 
 	entries := make(chan *mdns.ServiceEntry, 255)
@@ -125,8 +207,7 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 	var targetIPv4 *net.UDPAddr
 	var targetIPv6 *net.UDPAddr
 
-	targetIPv4 = network_ipv4Addr
-	targetIPv6 = network_ipv6Addr
+	targetIPv4, targetIPv6 = mdnsAddrs(ds.discoveryPort)
 
 	// Only look for Network Web Socket DNS-SD services
 	params := &mdns.QueryParam{
@@ -138,7 +219,12 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 		IPv6mdns: targetIPv6,
 	}
 
+	// Closed once the responses to this browse have been handled
+	handled := make(chan int)
+
 	go func() {
+		defer close(handled)
+
 		complete := false
 		timeoutFinish := time.After(timeout)
 
@@ -162,6 +248,10 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 					continue
 				}
 
+				ds.mu.Lock()
+				ds.advertisedDNSRecords[serviceRecord.Hash_Base64] = serviceRecord
+				ds.mu.Unlock()
+
 				// Ignore previously discovered Channel proxy services
 				if service.isActiveProxyService(serviceRecord) {
 					continue
@@ -169,7 +259,7 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 
 				// Resolve discovered service hash provided against available services
 				var channel *Channel
-				for _, knownService := range service.Channels {
+				for _, knownService := range service.getChannels() {
 					if bcrypt.Match(knownService.serviceName, serviceRecord.Hash_BCrypt) {
 						channel = knownService
 						break
@@ -189,8 +279,13 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 				}
 
 			case <-timeoutFinish:
-				// Replace unresolved DNS records cache
+				// Replace unresolved DNS records cache and start a new set of
+				// advertised DNS records
+				ds.mu.Lock()
 				ds.cachedDNSRecords = recordsCache
+				ds.lastAdvertisedDNSRecords = ds.advertisedDNSRecords
+				ds.advertisedDNSRecords = make(map[string]*DNSRecord)
+				ds.mu.Unlock()
 
 				complete = true
 			}
@@ -198,18 +293,69 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 	}()
 
 	// Run the mDNS/DNS-SD query
-	err := mdns.Query(params)
-
-	if err != nil {
+	if err := mdns.Query(params); err != nil {
 		log.Printf("Could not perform mDNS/DNS-SD query. %v", err)
-		return
 	}
+
+	<-handled
 }
 
 func (ds *DiscoveryBrowser) Shutdown() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
 	ds.closed = true
 }
 
+// Whether this discovery browser has been shut down
+func (ds *DiscoveryBrowser) isClosed() bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.closed
+}
+
+// Remove and return all cached DNS-SD records that resolve with the given
+// service name. Records that do not resolve remain in the cache.
+func (ds *DiscoveryBrowser) resolveCachedRecords(serviceName string) []*DNSRecord {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	resolvedRecords := make([]*DNSRecord, 0)
+
+	recordsCache := make(map[string]*DNSRecord)
+	for _, cachedRecord := range ds.cachedDNSRecords {
+		if bcrypt.Match(serviceName, cachedRecord.Hash_BCrypt) {
+			resolvedRecords = append(resolvedRecords, cachedRecord)
+		} else {
+			// Maintain as an unresolved entry in cache
+			recordsCache[cachedRecord.Hash_Base64] = cachedRecord
+		}
+	}
+
+	// Replace unresolved DNS-SD service entries cache
+	ds.cachedDNSRecords = recordsCache
+
+	return resolvedRecords
+}
+
+// Return the most recently seen DNS-SD record advertising the remote channel
+// with the given base64 hash, or nil if it was not seen during the current or
+// the last completed browse
+func (ds *DiscoveryBrowser) lookupAdvertisedRecord(hash string) *DNSRecord {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return nil
+	}
+
+	if record, ok := ds.advertisedDNSRecords[hash]; ok {
+		return record
+	}
+	return ds.lastAdvertisedDNSRecords[hash]
+}
+
 /** Network Web Socket DNS Record interface **/
 
 type DNSRecord struct {
@@ -0,0 +1,246 @@
+package networkwebsockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Maximum number of fragments a single payload can be split into
+	maxFragmentCount = 1 << 16
+
+	// Maximum number of partially reassembled payloads held at once
+	maxPartialMessages = 64
+)
+
+// JSON structure describing one part of a fragmented wire message payload
+type WireFragment struct {
+	// Identifier shared by all fragments of the same payload
+	Id string `json:"id"`
+
+	// Zero-based position of this fragment in the payload
+	Index int `json:"index"`
+
+	// Total number of fragments in the payload
+	Count int `json:"count"`
+}
+
+// Split a wire message into fragments that each encode to no more than
+// maxSize bytes. Messages that already fit are returned unchanged.
+func fragmentWireMessage(message *WireMessage, maxSize int) ([]*WireMessage, error) {
+	size, err := encodedWireMessageSize(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if size <= maxSize {
+		return []*WireMessage{message}, nil
+	}
+
+	// Measure the encoding overhead of a fragment with a one byte payload
+	header := *message
+	header.Payload = "x"
+	header.Fragment = &WireFragment{Id: GenerateId(), Index: maxFragmentCount, Count: maxFragmentCount}
+
+	overhead, err := encodedWireMessageSize(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := maxSize - overhead + 1
+	if budget < utf8.UTFMax*6 {
+		return nil, fmt.Errorf("Maximum message size of %d bytes is too small to fragment messages", maxSize)
+	}
+
+	var parts []string
+	for payload := message.Payload; len(payload) > 0; {
+		part := nextFragmentPayload(payload, budget, message.Binary)
+		parts = append(parts, part)
+		payload = payload[len(part):]
+	}
+
+	if len(parts) > maxFragmentCount {
+		return nil, fmt.Errorf("Message payload requires %d fragments (maximum is %d)", len(parts), maxFragmentCount)
+	}
+
+	fragmentId := GenerateId()
+
+	fragments := make([]*WireMessage, len(parts))
+	for i, part := range parts {
+		fragment := *message
+		fragment.Payload = part
+		fragment.Fragment = &WireFragment{Id: fragmentId, Index: i, Count: len(parts)}
+		fragments[i] = &fragment
+	}
+
+	return fragments, nil
+}
+
+// Return a prefix of payload that encodes to no more than budget bytes.
+// Text prefixes end on a UTF-8 character boundary.
+func nextFragmentPayload(payload string, budget int, binary bool) string {
+	if len(payload) <= budget && binary {
+		return payload
+	}
+
+	if binary {
+		return payload[:budget]
+	}
+
+	n := len(payload)
+	if n > budget {
+		n = budget
+	}
+
+	for {
+		// Back off to the start of a UTF-8 character
+		for n > 0 && n < len(payload) && !utf8.RuneStart(payload[n]) {
+			n--
+		}
+
+		if n == 0 {
+			// Always make progress by at least one character
+			_, size := utf8.DecodeRuneInString(payload)
+			return payload[:size]
+		}
+
+		// Check the size of the prefix once it has been escaped for JSON
+		encoded, _ := json.Marshal(payload[:n])
+		if len(encoded)-2 <= budget {
+			return payload[:n]
+		}
+
+		n = n / 2
+	}
+}
+
+// Size in bytes of the frame a wire message will be sent in
+func encodedWireMessageSize(message *WireMessage) (int, error) {
+	if message.Binary {
+		wireData, err := marshalBinaryWireMessage(message)
+		return len(wireData), err
+	}
+
+	wireData, err := marshalWireMessage(message)
+	return len(wireData), err
+}
+
+/** Fragmented wire message reassembly **/
+
+type partialWireMessage struct {
+	// Header of the first fragment received
+	header WireMessage
+
+	parts    []string
+	arrived  []bool
+	received int
+	size     int64
+
+	expires time.Time
+}
+
+type reassembler struct {
+	// Maximum size of a reassembled payload
+	maxSize int64
+
+	// Time allowed to receive all the fragments of a payload
+	timeout time.Duration
+
+	// Guards partials
+	mu sync.Mutex
+
+	// Partially reassembled payloads keyed by source and fragment id
+	partials map[string]*partialWireMessage
+}
+
+func newReassembler(maxSize int64, timeout time.Duration) *reassembler {
+	return &reassembler{
+		maxSize:  maxSize,
+		timeout:  timeout,
+		partials: make(map[string]*partialWireMessage),
+	}
+}
+
+// Add a fragment to the reassembly buffer. Returns the reassembled wire
+// message once all of its fragments have been received, or nil until then.
+func (r *reassembler) add(fragment *WireMessage) (*WireMessage, error) {
+	f := fragment.Fragment
+	if f == nil {
+		return fragment, nil
+	}
+
+	if f.Count < 1 || f.Count > maxFragmentCount || f.Index < 0 || f.Index >= f.Count {
+		return nil, fmt.Errorf("Invalid fragment %d of %d", f.Index, f.Count)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	// Discard payloads that were not completed in time
+	for key, partial := range r.partials {
+		if now.After(partial.expires) {
+			delete(r.partials, key)
+		}
+	}
+
+	key := fragment.Source + "/" + f.Id
+
+	partial := r.partials[key]
+	if partial == nil {
+		if len(r.partials) >= maxPartialMessages {
+			return nil, errors.New("Too many fragmented messages are being reassembled")
+		}
+
+		header := *fragment
+		header.Payload = ""
+		header.Fragment = nil
+
+		partial = &partialWireMessage{
+			header:  header,
+			parts:   make([]string, f.Count),
+			arrived: make([]bool, f.Count),
+			expires: now.Add(r.timeout),
+		}
+		r.partials[key] = partial
+	}
+
+	if len(partial.parts) != f.Count || partial.header.Binary != fragment.Binary {
+		delete(r.partials, key)
+		return nil, errors.New("Fragment does not match the message being reassembled")
+	}
+
+	if partial.arrived[f.Index] {
+		return nil, fmt.Errorf("Duplicate fragment %d of %d", f.Index, f.Count)
+	}
+
+	partial.size += int64(len(fragment.Payload))
+	if partial.size > r.maxSize {
+		delete(r.partials, key)
+		return nil, fmt.Errorf("Fragmented message exceeds maximum size of %d bytes", r.maxSize)
+	}
+
+	partial.parts[f.Index] = fragment.Payload
+	partial.arrived[f.Index] = true
+	partial.received++
+
+	if partial.received < f.Count {
+		return nil, nil
+	}
+
+	delete(r.partials, key)
+
+	message := partial.header
+	buf := make([]byte, 0, partial.size)
+	for _, part := range partial.parts {
+		buf = append(buf, part...)
+	}
+	message.Payload = string(buf)
+
+	return &message, nil
+}
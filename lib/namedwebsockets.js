@@ -8,6 +8,9 @@
 *     // Connect with other peers using the same service name in the current network
 *     var ws = new NetworkWebSocket("myServiceName");
 *
+*     // ...optionally publishing presence metadata to the other peers
+*     var ws = new NetworkWebSocket("myServiceName", [], { name: "Alice", capabilities: ["chat"] });
+*
 * ...then use the returned `ws` object just like a normal JavaScript WebSocket object.
 *
 **/
@@ -20,6 +23,88 @@ function isValidServiceName(channelName) {
 	return /^[A-Za-z0-9\=\+\._-]{1,255}$/.test(channelName);
 }
 
+// Maximum size in bytes of each message sent to the Network Web Socket proxy
+var maxMessageSize = 8192;
+
+// Length in bytes of a string once UTF-8 encoded
+function utf8Length(str) {
+	return unescape(encodeURIComponent(str)).length;
+}
+
+function generateId() {
+	return Math.floor(Math.random() * 0xFFFFFFFF).toString(16) + Date.now().toString(16);
+}
+
+// Send string data in the given message. Data that does not fit in a single
+// message is split into fragments that the proxy reassembles before delivery.
+function sendData(socket, message, data) {
+	message.data = data;
+
+	var json = JSON.stringify(message);
+	if (Object.prototype.toString.call(data) != '[object String]' || utf8Length(json) <= maxMessageSize) {
+		socket.send(json);
+		return;
+	}
+
+	// Leave room for the largest fragment header
+	message.data = "";
+	message.fragment = { "id": generateId(), "index": 65535, "count": 65536 };
+	var budget = maxMessageSize - utf8Length(JSON.stringify(message));
+
+	var parts = [], part = "", partSize = 0;
+	for (var i = 0; i < data.length; i++) {
+		var ch = data.charAt(i);
+		var code = data.charCodeAt(i);
+
+		// Keep surrogate pairs in the same part
+		if (code >= 0xD800 && code <= 0xDBFF && i + 1 < data.length) {
+			ch += data.charAt(++i);
+		}
+
+		// Size of this character once JSON escaped and UTF-8 encoded
+		var size = 1;
+		if (code < 0x20 || code >= 0x7F || ch == '"' || ch == '\\') {
+			size = utf8Length(JSON.stringify(ch)) - 2;
+		}
+
+		if (partSize + size > budget) {
+			parts.push(part);
+			part = "";
+			partSize = 0;
+		}
+		part += ch;
+		partSize += size;
+	}
+	parts.push(part);
+
+	for (var j = 0; j < parts.length; j++) {
+		message.data = parts[j];
+		message.fragment.index = j;
+		message.fragment.count = parts.length;
+		socket.send(JSON.stringify(message));
+	}
+}
+
+// Build the connection URL query that publishes the given presence metadata
+function metadataQuery(metadata) {
+	if (!metadata) {
+		return "";
+	}
+
+	var params = [];
+	var keys = ["name", "app", "version"];
+	for (var i = 0; i < keys.length; i++) {
+		if (metadata[keys[i]]) {
+			params.push(keys[i] + "=" + encodeURIComponent(metadata[keys[i]]));
+		}
+	}
+	if (metadata.capabilities && metadata.capabilities.length) {
+		params.push("capabilities=" + encodeURIComponent(metadata.capabilities.join(",")));
+	}
+
+	return params.length ? "?" + params.join("&") : "";
+}
+
 function toJson(data) {
     try {
         return JSON.parse(data);
@@ -27,16 +112,17 @@ function toJson(data) {
 		return false;
 }
 
-var _NetworkWebSocket = function (channelName, subprotocols) {
+var _NetworkWebSocket = function (channelName, subprotocols, metadata) {
 	if (!isValidServiceName(channelName)) {
 		throw "Invalid Service Name: " + channelName;
 	}
 
 	// *Actual* web socket connection to Network Web Socket proxy
-	var webSocket = new WebSocket(endpointUrlBase + channelName, subprotocols);
+	var webSocket = new WebSocket(endpointUrlBase + channelName + metadataQuery(metadata), subprotocols);
 
 	// Root NetworkWebSocket object
 	var networkWebSocket = new P2PWebSocket(webSocket);
+	networkWebSocket.metadata = metadata || null;
 
 	function getPeerById(id) {
 		for (var i = 0; i < networkWebSocket.peers.length; i++) {
@@ -55,11 +141,17 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 			throw "message cannot be sent because the web socket is not open";
 		}
 
-		var message = {
-			"action":  "broadcast",
-			"data": data
-		};
-		this.socket.send(JSON.stringify(message));
+		sendData(this.socket, { "action": "broadcast" }, data);
+	};
+
+	// Publish new presence metadata to all other channel peers
+	networkWebSocket.updateMetadata = function(metadata) {
+		if (this.readyState != P2PWebSocket.prototype.OPEN) {
+			throw "metadata cannot be updated because the web socket is not open";
+		}
+
+		this.socket.send(JSON.stringify({ "action": "update", "metadata": metadata }));
+		this.metadata = metadata;
 	};
 
 	// override
@@ -95,6 +187,7 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 
 				// Create a new WebSocket shim object
 				var peerWebSocket = new P2PWebSocket(webSocket, networkWebSocket, json.target);
+				peerWebSocket.metadata = json.metadata || null;
 
 				// Add to root web sockets p2p sockets enumeration
 				networkWebSocket.peers.push(peerWebSocket);
@@ -120,6 +213,27 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 
 				break;
 
+			case "update":
+				// fire update event on root network web socket object
+
+				var peerWebSocket = getPeerById(json.target);
+				if (!peerWebSocket) {
+					return;
+				}
+
+				peerWebSocket.metadata = json.metadata || null;
+
+				var updateEvt = new CustomEvent('update', {
+					"bubbles": false,
+					"cancelable": false,
+					"detail": {
+							"target": peerWebSocket
+					}
+				});
+				networkWebSocket.dispatchEvent(updateEvt);
+
+				break;
+
 			case "disconnect":
 				// close peer network web socket object
 
@@ -208,6 +322,7 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 
 var P2PWebSocket = function(rootWebSocket, parentWebSocket, targetId) {
 	this.id = targetId || "";
+	this.metadata = null; // presence metadata published by this peer, if any
 	this.socket = rootWebSocket;
 	this.parent = parentWebSocket;
 
@@ -227,12 +342,7 @@ P2PWebSocket.prototype.send = function(data) {
 		throw "message cannot be sent because the web socket is not open";
 	}
 
-	var message = {
-		"action":  "message",
-		"target":  this.id,
-		"data": data
-	};
-	this.socket.send(JSON.stringify(message));
+	sendData(this.socket, { "action": "message", "target": this.id }, data);
 };
 
 P2PWebSocket.prototype.close = function(code, reason) {
@@ -375,8 +485,8 @@ P2PWebSocket.prototype.CLOSED = 3;
 
 /**** END WEBSOCKET SHIM ****/
 
-var NetworkWebSocket = function (channelName, subprotocols) {
-	return new _NetworkWebSocket(channelName, subprotocols);
+var NetworkWebSocket = function (channelName, subprotocols, metadata) {
+	return new _NetworkWebSocket(channelName, subprotocols, metadata);
 };
 
 // Expose global functions
@@ -0,0 +1,121 @@
+package networkwebsockets
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Time for which the id of a relayed broadcast is remembered
+	seenMessageTimeout = time.Minute
+
+	// Maximum number of relayed broadcast ids remembered per channel
+	maxSeenMessages = 4096
+)
+
+// Remembers the ids of broadcasts relayed through a channel in mesh mode so
+// that broadcasts arriving again over another proxy connection are dropped
+type seenMessages struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newSeenMessages() *seenMessages {
+	return &seenMessages{
+		entries: make(map[string]time.Time),
+	}
+}
+
+// Record the given message key. Returns false if it has already been seen.
+func (seen *seenMessages) add(key string) bool {
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+
+	now := time.Now()
+
+	if expires, ok := seen.entries[key]; ok && now.Before(expires) {
+		return false
+	}
+
+	if len(seen.entries) >= maxSeenMessages {
+		for k, expires := range seen.entries {
+			if now.After(expires) {
+				delete(seen.entries, k)
+			}
+		}
+
+		// Forget the oldest entries all at once if none have expired
+		if len(seen.entries) >= maxSeenMessages {
+			seen.entries = make(map[string]time.Time)
+		}
+	}
+
+	seen.entries[key] = now.Add(seenMessageTimeout)
+
+	return true
+}
+
+// Whether this channel relays messages between its proxy connections
+func (channel *Channel) isMesh() bool {
+	return channel.service != nil && channel.service.config.Mesh
+}
+
+// Whether a message that has already been relayed the given number of times
+// may be relayed again
+func (channel *Channel) canRelay(hops int) bool {
+	return channel.isMesh() && hops+1 < channel.service.config.MeshMaxHops
+}
+
+// Relay a "connect", "update" or "disconnect" announcement received from one
+// proxy connection to every other writeable proxy connection of this channel
+func (channel *Channel) relayAnnouncement(message *WireMessage, from *Proxy) {
+	if !channel.canRelay(message.Hops) {
+		return
+	}
+
+	for _, proxy := range channel.getProxies() {
+		if proxy == from || !proxy.writeable {
+			continue
+		}
+		proxy.getTransport().writeWireMessage(&WireMessage{
+			Action:   message.Action,
+			Source:   proxy.base.id,
+			Target:   message.Target,
+			Metadata: message.Metadata,
+			Hops:     message.Hops + 1,
+		})
+	}
+}
+
+// Announce a peer id this channel can reach to every writeable proxy
+// connection so that a proxy connection that has lost its own route to it can
+// route through this channel instead
+func (channel *Channel) reannounce(id string) {
+	if peer := channel.getPeer(id); peer != nil {
+		channel.relayAnnouncement(&WireMessage{Action: "connect", Target: id, Metadata: peer.getMetadata(), Hops: -1}, nil)
+		return
+	}
+
+	if owner := channel.getProxyForPeer(id); owner != nil {
+		channel.relayAnnouncement(&WireMessage{Action: "connect", Target: id, Metadata: owner.getPeerMetadata(id), Hops: owner.getPeerHops(id) - 1}, owner)
+	}
+}
+
+// Forward a direct message, delivery receipt or error received from a proxy
+// connection towards a remote target over the proxy connection that owns the
+// target's peer id. Returns whether the message was forwarded.
+func (channel *Channel) routeMessage(message *WireMessage, from *Proxy) bool {
+	if !channel.canRelay(message.Hops) {
+		return false
+	}
+
+	owner := channel.getProxyForPeer(message.Target)
+	if owner == nil || owner == from {
+		return false
+	}
+
+	relayed := *message
+	relayed.Hops++
+
+	return owner.getTransport().writeWireMessage(&relayed) == nil
+}
@@ -0,0 +1,89 @@
+package networkwebsockets
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Maximum length of each metadata string
+	maxMetadataFieldLength = 256
+
+	// Maximum number of capabilities a peer can publish
+	maxMetadataCapabilities = 32
+)
+
+// PeerMetadata is the presence document a peer publishes to the other peers
+// of its channel. It is carried in "connect" and "update" messages.
+type PeerMetadata struct {
+	// Display name of the peer
+	Name string `json:"name,omitempty"`
+
+	// Name and version of the application the peer is running
+	App     string `json:"app,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	// Features the peer supports (e.g. "chat", "video")
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Parse peer metadata from the "name", "app", "version" and comma-separated
+// "capabilities" parameters of a channel URL query. Returns nil if none are set.
+func parsePeerMetadata(query url.Values) (*PeerMetadata, error) {
+	metadata := &PeerMetadata{
+		Name:    query.Get("name"),
+		App:     query.Get("app"),
+		Version: query.Get("version"),
+	}
+
+	if capabilities := query.Get("capabilities"); capabilities != "" {
+		metadata.Capabilities = strings.Split(capabilities, ",")
+	}
+
+	if metadata.isEmpty() {
+		return nil, nil
+	}
+
+	if err := metadata.validate(); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// Check that this metadata is small enough to be relayed to other peers
+func (metadata *PeerMetadata) validate() error {
+	for _, field := range []string{metadata.Name, metadata.App, metadata.Version} {
+		if len(field) > maxMetadataFieldLength {
+			return fmt.Errorf("Peer metadata fields must be no longer than %d bytes", maxMetadataFieldLength)
+		}
+	}
+
+	if len(metadata.Capabilities) > maxMetadataCapabilities {
+		return fmt.Errorf("Peer metadata can list no more than %d capabilities", maxMetadataCapabilities)
+	}
+
+	for _, capability := range metadata.Capabilities {
+		if len(capability) > maxMetadataFieldLength {
+			return fmt.Errorf("Peer metadata fields must be no longer than %d bytes", maxMetadataFieldLength)
+		}
+	}
+
+	return nil
+}
+
+func (metadata *PeerMetadata) isEmpty() bool {
+	return metadata.Name == "" && metadata.App == "" && metadata.Version == "" && len(metadata.Capabilities) == 0
+}
+
+// Return a copy of this metadata that does not share its capabilities slice
+func (metadata *PeerMetadata) clone() *PeerMetadata {
+	if metadata == nil {
+		return nil
+	}
+
+	c := *metadata
+	c.Capabilities = append([]string(nil), metadata.Capabilities...)
+	return &c
+}
@@ -0,0 +1,113 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OriginPolicy controls which web page origins may join channels through the
+// localhost endpoint. Patterns are matched case-insensitively against the
+// request's Origin header (e.g. "https://example.com") and may contain '*'
+// wildcards that match any sequence of characters (e.g. "https://*.example.com").
+//
+// Requests without an Origin header come from non-browser clients and are not
+// subject to this policy.
+type OriginPolicy struct {
+	// Origins that may join any channel not restricted in Channels. If empty,
+	// every origin that is not denied may join unless ApproveOrigin is set.
+	Allow []string
+
+	// Origins that may never join any channel. Checked before all other rules.
+	Deny []string
+
+	// Origins that may join specific channels, keyed by channel name. Only
+	// matching origins may join a channel listed here.
+	Channels map[string][]string
+
+	// Called for origins that no Allow pattern matches so that an embedding
+	// application can ask the user whether to approve them. Returns whether
+	// the origin may join the named channel.
+	ApproveOrigin func(origin, channelName string) bool
+}
+
+// Check whether the given origin may join the named channel
+func (policy *OriginPolicy) check(origin, channelName string) error {
+	if origin == "" {
+		return nil
+	}
+
+	if matchOriginPatterns(policy.Deny, origin) {
+		return errors.New("Origin is denied")
+	}
+
+	if patterns, ok := policy.Channels[channelName]; ok {
+		if !matchOriginPatterns(patterns, origin) {
+			return fmt.Errorf("Origin is not allowed to join the '%s' channel", channelName)
+		}
+		return nil
+	}
+
+	if matchOriginPatterns(policy.Allow, origin) {
+		return nil
+	}
+
+	if policy.ApproveOrigin != nil {
+		if !policy.ApproveOrigin(origin, channelName) {
+			return errors.New("Origin was not approved")
+		}
+		return nil
+	}
+
+	if len(policy.Allow) > 0 {
+		return errors.New("Origin is not allowed")
+	}
+
+	return nil
+}
+
+// Whether origin matches any of the given patterns
+func matchOriginPatterns(patterns []string, origin string) bool {
+	for _, pattern := range patterns {
+		if matchOriginPattern(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether origin matches a pattern, ignoring case
+func matchOriginPattern(pattern, origin string) bool {
+	return matchPattern(strings.ToLower(pattern), strings.ToLower(origin))
+}
+
+// Whether s matches a pattern in which each '*' matches any sequence of characters
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	// The text before the first wildcard and after the last must match exactly
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	if len(s) < len(last) || !strings.HasSuffix(s, last) {
+		return false
+	}
+	s = s[:len(s)-len(last)]
+
+	// Match the remaining parts in order, as early as possible
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	return true
+}
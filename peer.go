@@ -2,7 +2,7 @@ package networkwebsockets
 
 import (
 	"errors"
-	"time"
+	"sync"
 
 	"github.com/richtr/websocket"
 )
@@ -17,7 +17,19 @@ type Peer struct {
 	// Transport object
 	transport *Transport
 
+	// Reassembles fragmented direct messages sent to this peer
+	reassembler *reassembler
+
+	// Limits the messages accepted from this connection. nil if unlimited.
+	limiter *rateLimiter
+
+	// Guards active and metadata
+	mu sync.Mutex
+
 	active bool
+
+	// Presence metadata published by this peer connection, if any
+	metadata *PeerMetadata
 }
 
 type PeerMessageHandler struct {
@@ -25,16 +37,29 @@ type PeerMessageHandler struct {
 }
 
 func (handler *PeerMessageHandler) Read(buf []byte) error {
-	peer := handler.peer
-	if peer == nil {
-		return errors.New("PeerMessageHandler requires an attached Peer object")
+	message, err := decodeWireMessage(buf)
+	if err != nil {
+		return err
 	}
 
-	message, err := decodeWireMessage(buf)
+	return handler.handle(message)
+}
+
+func (handler *PeerMessageHandler) ReadBinary(buf []byte) error {
+	message, err := decodeBinaryWireMessage(buf)
 	if err != nil {
 		return err
 	}
 
+	return handler.handle(message)
+}
+
+func (handler *PeerMessageHandler) handle(message WireMessage) error {
+	peer := handler.peer
+	if peer == nil {
+		return errors.New("PeerMessageHandler requires an attached Peer object")
+	}
+
 	switch message.Action {
 
 	case "connect":
@@ -42,29 +67,52 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 		// 'connect' and 'disconnect' events are write-only so will not be handled here
 		return nil
 
-	case "status":
+	case "update":
 
-		// Echo peer id back to callee
-		wireData, err := encodeWireMessage("status", peer.id, peer.id, "")
+		if !peer.throttle(&message) {
+			return nil
+		}
 
-		if err != nil {
+		if message.Metadata == nil {
+			return errors.New("Update must include metadata")
+		}
+
+		if err := message.Metadata.validate(); err != nil {
 			return err
 		}
 
-		peer.transport.Write(wireData)
+		peer.setMetadata(message.Metadata)
+		peer.announceUpdate()
 
 		return nil
 
+	case "status":
+
+		// Echo peer id back to callee along with the ids of all the other
+		// peer connections in this channel
+		return peer.transport.writeWireMessage(&WireMessage{
+			Action: "status",
+			Source: peer.id,
+			Target: peer.id,
+			Peers:  peer.channel.getPeerIds(peer.id),
+		})
+
 	case "broadcast":
 
+		if !peer.throttle(&message) {
+			return nil
+		}
+
 		wsBroadcast := &WireMessage{
 			Action:    "broadcast",
 			Source:    peer.id,
 			Target:    "", // target all connections
 			Payload:   message.Payload,
+			Fragment:  message.Fragment,
+			Binary:    message.Binary,
 			fromProxy: false,
 		}
-		peer.channel.broadcastBuffer <- wsBroadcast
+		peer.channel.broadcast(wsBroadcast)
 
 		return nil
 
@@ -74,53 +122,78 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 			return errors.New("Message must have a target identifier")
 		}
 
-		wireData, err := encodeWireMessage("message", peer.id, message.Target, message.Payload)
+		if !peer.throttle(&message) {
+			return nil
+		}
 
-		if err != nil {
-			return err
+		wsMessage := &WireMessage{
+			Action:   "message",
+			Id:       message.Id,
+			Request:  message.Request,
+			ReplyTo:  message.ReplyTo,
+			Error:    message.Error,
+			Source:   peer.id,
+			Target:   message.Target,
+			Payload:  message.Payload,
+			Fragment: message.Fragment,
+			Binary:   message.Binary,
 		}
 
 		// Relay message to peer channel that matches target
-		for _, _peer := range peer.channel.peers {
-			if _peer.id == message.Target {
-				_peer.transport.Write(wireData)
-				return nil
+		if _peer := peer.channel.getPeer(message.Target); _peer != nil {
+			delivered, err := _peer.deliver(wsMessage)
+			if delivered || err != nil {
+				peer.acknowledge(wsMessage, err)
 			}
+			return err
 		}
 
 		// If we have not delivered the message yet then hunt for a
-		// proxy that owns target peer id in known proxies
-		for _, proxy := range peer.channel.proxies {
-			if proxy.peerIds[message.Target] {
-				proxy.base.transport.Write(wireData)
-				return nil
+		// proxy that owns target peer id in known proxies. The remote
+		// service acknowledges the message on our behalf.
+		if proxy := peer.channel.getProxyForPeer(message.Target); proxy != nil {
+			err := proxy.getTransport().writeWireMessage(wsMessage)
+			if err != nil {
+				peer.acknowledge(wsMessage, err)
 			}
+			return err
 		}
 
+		err := errors.New("Could not find target for message")
+		peer.acknowledge(wsMessage, err)
+		return err
+
 	}
 
 	return errors.New("Could not find target for message")
 }
 
 func (handler *PeerMessageHandler) Write(buf []byte) error {
+	return handler.write(websocket.TextMessage, buf)
+}
+
+func (handler *PeerMessageHandler) WriteBinary(buf []byte) error {
+	return handler.write(websocket.BinaryMessage, buf)
+}
+
+func (handler *PeerMessageHandler) write(messageType int, buf []byte) error {
 	peer := handler.peer
 	if peer == nil {
 		return errors.New("PeerMessageHandler requires an attached Peer object")
 	}
 
-	if !peer.active {
+	if !peer.isActive() {
 		return errors.New("Peer is not active")
 	}
 
-	peer.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	peer.transport.conn.WriteMessage(websocket.TextMessage, buf)
-
-	return nil
+	return peer.transport.writeMessage(messageType, buf)
 }
 
 func NewPeer(conn *websocket.Conn) *Peer {
 	peerConn := &Peer{
 		id: GenerateId(),
+
+		reassembler: newReassembler(DefaultMaxReassembledMessageSize, DefaultReassemblyTimeout),
 	}
 
 	// Create a new peer socket message handler
@@ -140,11 +213,31 @@ func (peer *Peer) Start(channel *Channel) error {
 		return errors.New("Peer requires a channel to start")
 	}
 
+	peer.mu.Lock()
 	if peer.active {
+		peer.mu.Unlock()
 		return errors.New("Peer is already started")
 	}
-
 	peer.channel = channel
+	peer.active = true
+	peer.mu.Unlock()
+
+	// Apply the channel's service limits to this connection
+	if channel.service != nil {
+		config := &channel.service.config
+		peer.transport.configure(config, config.MaxMessageSize)
+		peer.reassembler = newReassembler(config.MaxReassembledMessageSize, config.ReassemblyTimeout)
+		peer.limiter = newRateLimiter(config.PeerRateLimit)
+	}
+
+	// Add reference to this peer connection to channel
+	peers, proxies, err := channel.addPeer(peer)
+	if err != nil {
+		peer.mu.Lock()
+		peer.active = false
+		peer.mu.Unlock()
+		return err
+	}
 
 	// Start connection read/write pumps
 	peer.transport.Start()
@@ -153,82 +246,133 @@ func (peer *Peer) Start(channel *Channel) error {
 		peer.Stop()
 	}()
 
-	peer.active = true
-
-	// Add reference to this peer connection to channel
-	peer.addConnection()
+	peer.announceConnection(peers, proxies)
 
 	return nil
 }
 
 func (peer *Peer) Stop() error {
+	peer.mu.Lock()
 	if !peer.active {
+		peer.mu.Unlock()
 		return errors.New("Peer cannot be stopped because it is not currently active")
 	}
+	peer.active = false
+	peer.mu.Unlock()
 
 	// Remove references to this peer connection from channel
-	peer.removeConnection()
+	peers, proxies := peer.channel.removePeer(peer)
+
+	peer.announceDisconnection(peers, proxies)
 
 	// Close websocket connection
 	peer.transport.Stop()
 
 	// If no more local peers are connected then remove the current Network Web Socket service
-	if len(peer.channel.peers) == 0 {
+	if len(peers) == 0 {
 		peer.channel.Stop()
 	}
 
-	peer.active = false
-
 	return nil
 }
 
-// Set up a new Channel connection instance
-func (peer *Peer) addConnection() {
-	// Add this websocket instance to Network Web Socket broadcast list
-	peer.channel.peers = append(peer.channel.peers, peer)
+// Deliver a direct message to this peer connection. Fragmented messages are
+// delivered as a single message once all of their fragments have arrived.
+// Returns whether a complete message was delivered.
+func (peer *Peer) deliver(message *WireMessage) (bool, error) {
+	message, err := peer.reassembler.add(message)
+	if err != nil || message == nil {
+		return false, err
+	}
+
+	if err := peer.transport.writeWireMessage(message); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Send an "ack" (or a "nack" if err is not nil) for a direct message sent
+// by this peer connection
+func (peer *Peer) acknowledge(message *WireMessage, err error) {
+	if receipt := newDeliveryReceipt(message, err); receipt != nil {
+		peer.transport.writeWireMessage(receipt)
+	}
+}
+
+// Return a copy of the metadata published by this peer connection, if any
+func (peer *Peer) getMetadata() *PeerMetadata {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	return peer.metadata.clone()
+}
+
+func (peer *Peer) setMetadata(metadata *PeerMetadata) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	peer.metadata = metadata.clone()
+}
 
-	for _, _peer := range peer.channel.peers {
+// Whether this peer connection is currently started
+func (peer *Peer) isActive() bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	return peer.active
+}
+
+// Inform the other connections of a Channel that we now own this peer
+// connection and inform this peer of all the other connections we know about
+func (peer *Peer) announceConnection(peers []*Peer, proxies []*Proxy) {
+	metadata := peer.getMetadata()
+
+	for _, _peer := range peers {
 		if _peer.id != peer.id {
 			// Inform other local peer connections that we now own this peer
-			if wireData, err := encodeWireMessage("connect", _peer.id, peer.id, ""); err == nil {
-				_peer.transport.Write(wireData)
-			}
+			_peer.transport.writeWireMessage(&WireMessage{Action: "connect", Source: _peer.id, Target: peer.id, Metadata: metadata})
 
 			// Inform this peer of all the other peer connections we own
-			if wireData, err := encodeWireMessage("connect", peer.id, _peer.id, ""); err == nil {
-				peer.transport.Write(wireData)
-			}
+			peer.transport.writeWireMessage(&WireMessage{Action: "connect", Source: peer.id, Target: _peer.id, Metadata: _peer.getMetadata()})
 		}
 	}
 
-	for _, proxy := range peer.channel.proxies {
+	for _, proxy := range proxies {
 		// Inform all proxy connections that we now own this peer connection
 		if proxy.writeable {
-			if wireData, err := encodeWireMessage("connect", proxy.base.id, peer.id, ""); err == nil {
-				proxy.base.transport.Write(wireData)
-			}
+			proxy.getTransport().writeWireMessage(&WireMessage{Action: "connect", Source: proxy.base.id, Target: peer.id, Metadata: metadata})
 		}
 		// Inform current peer of all the peer connections other connected proxies own
-		for peerId, _ := range proxy.peerIds {
-			if wireData, err := encodeWireMessage("connect", proxy.base.id, peerId, ""); err == nil {
-				peer.transport.Write(wireData)
-			}
+		for _, peerId := range proxy.getPeerIds() {
+			peer.transport.writeWireMessage(&WireMessage{Action: "connect", Source: proxy.base.id, Target: peerId, Metadata: proxy.getPeerMetadata(peerId)})
 		}
 	}
 }
 
-// Tear down an existing Channel connection instance
-func (peer *Peer) removeConnection() {
-	for i, conn := range peer.channel.peers {
-		if conn.id == peer.id {
-			peer.channel.peers[i] = nil
-			peer.channel.peers = append(peer.channel.peers[:i], peer.channel.peers[i+1:]...)
-			break
+// Inform the other connections of a Channel that this peer connection has
+// published new metadata
+func (peer *Peer) announceUpdate() {
+	metadata := peer.getMetadata()
+
+	for _, _peer := range peer.channel.getPeers() {
+		if _peer.id != peer.id {
+			_peer.transport.writeWireMessage(&WireMessage{Action: "update", Source: _peer.id, Target: peer.id, Metadata: metadata})
 		}
 	}
 
+	for _, proxy := range peer.channel.getProxies() {
+		if proxy.writeable {
+			proxy.getTransport().writeWireMessage(&WireMessage{Action: "update", Source: proxy.base.id, Target: peer.id, Metadata: metadata})
+		}
+	}
+}
+
+// Inform the remaining connections of a Channel that we no longer own this
+// peer connection
+func (peer *Peer) announceDisconnection(peers []*Peer, proxies []*Proxy) {
 	// Inform all local peer connections that we no longer own this peer connection
-	for _, _peer := range peer.channel.peers {
+	for _, _peer := range peers {
 		// don't notify peer if its id matches the peer's id
 		if _peer.id != peer.id {
 			if wireData, err := encodeWireMessage("disconnect", _peer.id, peer.id, ""); err == nil {
@@ -238,10 +382,10 @@ func (peer *Peer) removeConnection() {
 	}
 
 	// Inform all proxy connections that we no longer own this peer connection
-	for _, proxy := range peer.channel.proxies {
+	for _, proxy := range proxies {
 		if proxy.writeable {
 			if wireData, err := encodeWireMessage("disconnect", proxy.base.id, peer.id, ""); err == nil {
-				proxy.base.transport.Write(wireData)
+				proxy.getTransport().Write(wireData)
 			}
 		}
 	}
@@ -3,24 +3,47 @@ package networkwebsockets
 import (
 	"errors"
 	"fmt"
-	"time"
+	"sync"
 
 	"github.com/richtr/websocket"
 )
 
 type Proxy struct {
-	// Inherit attributes from Peer struct
+	// Inherit attributes from Peer struct. base.mu also guards base.transport,
+	// record and state since the transport is replaced when a lost proxy link
+	// is re-established.
 	base Peer
 
-	// Discovered proxy connection's base64 hash value
-	// empty unless set via .setHash_Base64()
+	// Base64 service hash of the remote channel this proxy connection links to.
+	// Empty unless set via .setHash_Base64()
 	Hash_Base64 string
 
-	// List of connection ids that this proxy connection 'owns'
-	peerIds map[string]bool
+	// Guards peerIds, peerHops and limiters
+	mu sync.RWMutex
+
+	// Connection ids that this proxy connection 'owns' and the metadata each
+	// connection has published
+	peerIds map[string]*PeerMetadata
+
+	// Number of proxy hops to each owned connection id
+	peerHops map[string]int
+
+	// Rate limits applied to the messages relayed from each owned connection id
+	limit    RateLimit
+	limiters map[string]*rateLimiter
 
 	// Whether this proxy connection is writeable
 	writeable bool
+
+	// DNS-SD record this proxy connection was dialed from. nil for proxy
+	// connections accepted from remote services.
+	record *DNSRecord
+
+	// Health of this proxy link
+	state ProxyState
+
+	quit chan int // closed when .Stop() is called
+	done chan int // closed once .Stop() has completed
 }
 
 type ProxyMessageHandler struct {
@@ -28,97 +51,205 @@ type ProxyMessageHandler struct {
 }
 
 func (handler *ProxyMessageHandler) Read(buf []byte) error {
-	proxy := handler.proxy
-	if proxy == nil {
-		return errors.New("ProxyMessageHandler requires an attached Proxy object")
+	message, err := decodeWireMessage(buf)
+	if err != nil {
+		return err
 	}
 
-	message, err := decodeWireMessage(buf)
+	return handler.handle(message)
+}
+
+func (handler *ProxyMessageHandler) ReadBinary(buf []byte) error {
+	message, err := decodeBinaryWireMessage(buf)
 	if err != nil {
 		return err
 	}
 
+	return handler.handle(message)
+}
+
+func (handler *ProxyMessageHandler) handle(message WireMessage) error {
+	proxy := handler.proxy
+	if proxy == nil {
+		return errors.New("ProxyMessageHandler requires an attached Proxy object")
+	}
+
 	switch message.Action {
-	case "connect":
+	case "connect", "update":
 
-		proxy.peerIds[message.Target] = true
+		if message.Metadata != nil {
+			if err := message.Metadata.validate(); err != nil {
+				return err
+			}
+		}
 
-		// Inform all local peer connections that this proxy owns this peer connection
-		for _, peer := range proxy.base.channel.peers {
-			if wireData, err := encodeWireMessage("connect", peer.id, message.Target, ""); err == nil {
-				peer.transport.Write(wireData)
+		channel := proxy.base.channel
+
+		if message.Action == "update" && !proxy.hasPeerId(message.Target) {
+			return errors.New("Update target is not owned by this proxy")
+		}
+
+		if message.Action == "connect" && channel.isMesh() {
+			// Keep the first route to each peer id. This also ignores our own
+			// peers when they are announced back to us.
+			if channel.isPeerIdTaken(message.Target, nil) {
+				return nil
 			}
+		} else if message.Action == "connect" && channel.isPeerIdTaken(message.Target, proxy) {
+			// Refuse remote peer ids that are already in use in this channel
+			return fmt.Errorf("Peer id collision detected for '%s'. Remote peer ignored.", message.Target)
 		}
 
+		proxy.addPeerId(message.Target, message.Metadata, message.Hops+1)
+
+		// Inform all local peer connections that this proxy owns this peer
+		// connection (or that it has published new metadata)
+		for _, peer := range channel.getPeers() {
+			peer.transport.writeWireMessage(&WireMessage{Action: message.Action, Source: peer.id, Target: message.Target, Metadata: message.Metadata})
+		}
+
+		// Pass the announcement on to our other proxies in mesh mode
+		channel.relayAnnouncement(&message, proxy)
+
 		return nil
 
 	case "disconnect":
 
-		delete(proxy.peerIds, message.Target)
+		channel := proxy.base.channel
+
+		// Ignore peer ids this proxy does not own. In mesh mode the remote
+		// has lost its route to this peer so offer it ours instead.
+		if !proxy.hasPeerId(message.Target) {
+			if channel.isMesh() {
+				channel.reannounce(message.Target)
+			}
+			return nil
+		}
+
+		proxy.removePeerId(message.Target)
 
 		// Inform all local peer connections that this proxy no longer owns this peer connection
-		for _, peer := range proxy.base.channel.peers {
+		for _, peer := range channel.getPeers() {
 			if wireData, err := encodeWireMessage("disconnect", peer.id, message.Target, ""); err == nil {
 				peer.transport.Write(wireData)
 			}
 		}
 
+		// Pass the announcement on to our other proxies in mesh mode
+		channel.relayAnnouncement(&message, proxy)
+
 		return nil
 
 	case "broadcast":
 
+		if !proxy.throttle(&message) {
+			return nil
+		}
+
+		// Drop broadcasts that have already reached this channel over another proxy
+		if message.Id != "" && proxy.base.channel.isMesh() && !proxy.base.channel.seen.add(message.Source+"/"+message.Id) {
+			return nil
+		}
+
 		// broadcast message on to given target
 		wsBroadcast := &WireMessage{
 			Action:    "broadcast",
+			Id:        message.Id,
 			Source:    message.Source,
 			Target:    "", // target all connections
 			Payload:   message.Payload,
+			Fragment:  message.Fragment,
+			Binary:    message.Binary,
+			Hops:      message.Hops,
 			fromProxy: true,
+			via:       proxy,
 		}
 
-		proxy.base.channel.broadcastBuffer <- wsBroadcast
+		proxy.base.channel.broadcast(wsBroadcast)
 
 		return nil
 
 	case "message":
 
-		messageSent := false
+		if !proxy.throttle(&message) {
+			return nil
+		}
+
+		wsMessage := &WireMessage{
+			Action:   "message",
+			Id:       message.Id,
+			Request:  message.Request,
+			ReplyTo:  message.ReplyTo,
+			Error:    message.Error,
+			Source:   message.Source,
+			Target:   message.Target,
+			Payload:  message.Payload,
+			Fragment: message.Fragment,
+			Binary:   message.Binary,
+			Hops:     message.Hops,
+		}
 
 		// Relay message to channel peer that matches target
-		for _, peer := range proxy.base.channel.peers {
-			if peer.id == message.Target {
-				if wireData, err := encodeWireMessage("message", message.Source, message.Target, message.Payload); err == nil {
-					peer.transport.Write(wireData)
-				}
-				messageSent = true
-				break
+		peer := proxy.base.channel.getPeer(message.Target)
+		if peer == nil {
+			// Forward to a remote target over another proxy in mesh mode
+			if proxy.base.channel.routeMessage(wsMessage, proxy) {
+				return nil
 			}
+
+			err := errors.New("P2P message target could not be found. Not sent.")
+			proxy.acknowledge(wsMessage, err)
+			return err
 		}
 
-		if !messageSent {
-			fmt.Errorf("P2P message target could not be found. Not sent.")
+		delivered, err := peer.deliver(wsMessage)
+		if delivered || err != nil {
+			proxy.acknowledge(wsMessage, err)
 		}
+		return err
 
-		return nil
+	case "ack", "nack", "error":
+
+		// Relay delivery receipt or error to the channel peer that sent the message
+		peer := proxy.base.channel.getPeer(message.Target)
+		if peer == nil {
+			if proxy.base.channel.routeMessage(&message, proxy) {
+				return nil
+			}
+			return errors.New("Delivery receipt target could not be found. Not sent.")
+		}
+
+		return peer.transport.writeWireMessage(&WireMessage{
+			Action:  message.Action,
+			Id:      message.Id,
+			Source:  message.Source,
+			Target:  message.Target,
+			Payload: message.Payload,
+		})
 	}
 
 	return errors.New("Could not find target for message")
 }
 
 func (handler *ProxyMessageHandler) Write(buf []byte) error {
+	return handler.write(websocket.TextMessage, buf)
+}
+
+func (handler *ProxyMessageHandler) WriteBinary(buf []byte) error {
+	return handler.write(websocket.BinaryMessage, buf)
+}
+
+func (handler *ProxyMessageHandler) write(messageType int, buf []byte) error {
 	proxy := handler.proxy
 	if proxy == nil {
 		return errors.New("ProxyMessageHandler requires an attached Proxy object")
 	}
 
-	if !proxy.base.active {
+	if !proxy.base.isActive() {
 		return errors.New("Proxy is not active")
 	}
 
-	proxy.base.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	proxy.base.transport.conn.WriteMessage(websocket.TextMessage, buf)
-
-	return nil
+	return proxy.getTransport().writeMessage(messageType, buf)
 }
 
 func NewProxy(conn *websocket.Conn, isWriteable bool) *Proxy {
@@ -128,7 +259,11 @@ func NewProxy(conn *websocket.Conn, isWriteable bool) *Proxy {
 		},
 		Hash_Base64: "",
 		writeable:   isWriteable,
-		peerIds:     make(map[string]bool),
+		peerIds:     make(map[string]*PeerMetadata),
+		peerHops:    make(map[string]int),
+		limiters:    make(map[string]*rateLimiter),
+		quit:        make(chan int),
+		done:        make(chan int),
 	}
 
 	// Create a new peer socket message handler
@@ -148,82 +283,260 @@ func (proxy *Proxy) Start(channel *Channel) error {
 		return errors.New("Proxy requires a channel to start")
 	}
 
+	proxy.base.mu.Lock()
 	if proxy.base.active {
+		proxy.base.mu.Unlock()
 		return errors.New("Proxy is already started")
 	}
-
 	proxy.base.channel = channel
-
-	// Start connection read/write pumps
-	proxy.base.transport.Start()
-	go func() {
-		<-proxy.base.transport.StopNotify()
-		proxy.Stop()
-	}()
-
 	proxy.base.active = true
+	proxy.state = ProxyConnected
+	proxy.base.mu.Unlock()
+
+	// Apply the channel's service limits to this connection
+	if channel.service != nil {
+		config := &channel.service.config
+		proxy.base.transport.configure(config, config.ProxyMaxMessageSize)
+		proxy.base.limiter = newRateLimiter(config.ProxyRateLimit)
+
+		proxy.mu.Lock()
+		proxy.limit = config.ProxyRateLimit
+		proxy.mu.Unlock()
+	}
 
 	// Add reference to this proxy connection to channel
-	proxy.addConnection()
+	peers, err := channel.addProxy(proxy)
+	if err != nil {
+		proxy.base.mu.Lock()
+		proxy.base.active = false
+		proxy.state = ProxyFailed
+		proxy.base.mu.Unlock()
+		return err
+	}
+
+	// Start connection read/write pumps
+	transport := proxy.getTransport()
+	transport.Start()
+	go proxy.maintain(transport)
+
+	proxy.announce(peers)
 
 	return nil
 }
 
+// Inform the remote end of this proxy connection of the given local peer
+// connections and of all the peer connections we can route to in mesh mode
+func (proxy *Proxy) announce(peers []*Peer) {
+	if !proxy.writeable {
+		return
+	}
+
+	channel := proxy.base.channel
+	transport := proxy.getTransport()
+
+	for _, peer := range peers {
+		transport.writeWireMessage(&WireMessage{Action: "connect", Source: proxy.base.id, Target: peer.id, Metadata: peer.getMetadata()})
+	}
+
+	for _, other := range channel.getProxies() {
+		if other == proxy {
+			continue
+		}
+		for _, peerId := range other.getPeerIds() {
+			hops := other.getPeerHops(peerId)
+			if channel.canRelay(hops - 1) {
+				transport.writeWireMessage(&WireMessage{Action: "connect", Source: proxy.base.id, Target: peerId, Metadata: other.getPeerMetadata(peerId), Hops: hops})
+			}
+		}
+	}
+}
+
 func (proxy *Proxy) Stop() error {
+	proxy.base.mu.Lock()
 	if !proxy.base.active {
+		proxy.base.mu.Unlock()
 		return errors.New("Proxy cannot be stopped because it is not currently active")
 	}
+	proxy.base.active = false
+	proxy.state = ProxyFailed
+	select {
+	case <-proxy.quit:
+	default:
+		close(proxy.quit)
+	}
+	proxy.base.mu.Unlock()
 
 	// Remove references to this proxy connection from channel
-	proxy.removeConnection()
+	peers := proxy.base.channel.removeProxy(proxy)
+
+	// The remote peer connections this proxy owned are no longer reachable
+	proxy.dropPeerIds()
+
+	transport := proxy.getTransport()
+
+	if proxy.writeable {
+		// Inform this proxy of all the peer connections we no longer own
+		for _, peer := range peers {
+			if wireData, err := encodeWireMessage("disconnect", proxy.base.id, peer.id, ""); err == nil {
+				transport.writeMessage(websocket.TextMessage, wireData)
+			}
+		}
+	}
 
 	// Close underlying websocket connection
-	proxy.base.transport.Stop()
+	transport.Stop()
 
 	// If no more local peers are connected then remove the current Network Web Socket service
-	if len(proxy.base.channel.peers) == 0 {
+	if len(peers) == 0 {
 		proxy.base.channel.Stop()
 	}
 
-	proxy.base.active = false
+	close(proxy.done)
 
 	return nil
 }
 
-func (proxy *Proxy) setHash_Base64(hash string) {
-	proxy.Hash_Base64 = hash
+// StopNotify returns a channel that is closed once this proxy connection has
+// been stopped
+func (proxy *Proxy) StopNotify() <-chan int { return proxy.done }
+
+// Send an "ack" (or a "nack" if err is not nil) back over this proxy
+// connection for a direct message received from it
+func (proxy *Proxy) acknowledge(message *WireMessage, err error) {
+	if receipt := newDeliveryReceipt(message, err); receipt != nil {
+		proxy.getTransport().writeWireMessage(receipt)
+	}
 }
 
-// Set up a new Channel connection instance
-func (proxy *Proxy) addConnection() {
-	proxy.base.channel.proxies = append(proxy.base.channel.proxies, proxy)
+// Return the transport of this proxy connection's current websocket
+func (proxy *Proxy) getTransport() *Transport {
+	proxy.base.mu.Lock()
+	defer proxy.base.mu.Unlock()
 
-	if proxy.writeable {
-		// Inform this proxy of all the peer connections we own
-		for _, peer := range proxy.base.channel.peers {
-			if wireData, err := encodeWireMessage("connect", proxy.base.id, peer.id, ""); err == nil {
-				proxy.base.transport.Write(wireData)
+	return proxy.base.transport
+}
+
+// Whether this proxy connection was dialed from a DNS-SD record rather than
+// accepted from a remote service
+func (proxy *Proxy) isDialed() bool {
+	proxy.base.mu.Lock()
+	defer proxy.base.mu.Unlock()
+
+	return proxy.record != nil
+}
+
+// State returns the health of this proxy link
+func (proxy *Proxy) State() ProxyState {
+	proxy.base.mu.Lock()
+	defer proxy.base.mu.Unlock()
+
+	return proxy.state
+}
+
+// Forget all the peer ids this proxy connection owns. Local peer connections
+// and, in mesh mode, our other proxy connections are told they have gone.
+func (proxy *Proxy) dropPeerIds() {
+	channel := proxy.base.channel
+	peers := channel.getPeers()
+
+	for _, peerId := range proxy.getPeerIds() {
+		hops := proxy.getPeerHops(peerId)
+		proxy.removePeerId(peerId)
+
+		for _, peer := range peers {
+			if wireData, err := encodeWireMessage("disconnect", peer.id, peerId, ""); err == nil {
+				peer.transport.Write(wireData)
 			}
 		}
+
+		channel.relayAnnouncement(&WireMessage{Action: "disconnect", Target: peerId, Hops: hops - 1}, proxy)
 	}
 }
 
-// Tear down an existing Channel connection instance
-func (proxy *Proxy) removeConnection() {
-	for i, conn := range proxy.base.channel.proxies {
-		if proxy.base.id == conn.base.id {
-			proxy.base.channel.proxies[i] = nil // allow to be garbage-collected
-			proxy.base.channel.proxies = append(proxy.base.channel.proxies[:i], proxy.base.channel.proxies[i+1:]...)
-			break
-		}
+func (proxy *Proxy) setHash_Base64(hash string) {
+	proxy.Hash_Base64 = hash
+}
+
+// Record that this proxy connection owns the given peer id, the metadata that
+// peer connection has published and how many proxy hops away it is
+func (proxy *Proxy) addPeerId(id string, metadata *PeerMetadata, hops int) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	proxy.peerIds[id] = metadata.clone()
+	proxy.peerHops[id] = hops
+}
+
+// Record that this proxy connection no longer owns the given peer id
+func (proxy *Proxy) removePeerId(id string) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	delete(proxy.peerIds, id)
+	delete(proxy.peerHops, id)
+	delete(proxy.limiters, id)
+}
+
+// Return the rate limiter for messages relayed from the given connection id.
+// Connection ids this proxy connection does not own share the limiter of the
+// proxy connection itself.
+func (proxy *Proxy) getLimiter(id string) *rateLimiter {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	if _, ok := proxy.peerIds[id]; !ok {
+		return proxy.base.limiter
 	}
 
-	if proxy.writeable {
-		// Inform this proxy of all the peer connections we no longer own
-		for _, peer := range proxy.base.channel.peers {
-			if wireData, err := encodeWireMessage("disconnect", proxy.base.id, peer.id, ""); err == nil {
-				proxy.base.transport.Write(wireData)
-			}
-		}
+	limiter, ok := proxy.limiters[id]
+	if !ok {
+		limiter = newRateLimiter(proxy.limit)
+		proxy.limiters[id] = limiter
 	}
+	return limiter
+}
+
+// Whether this proxy connection owns the given peer id
+func (proxy *Proxy) hasPeerId(id string) bool {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+
+	_, ok := proxy.peerIds[id]
+	return ok
+}
+
+// Return a copy of the metadata published by the given peer id, if any
+func (proxy *Proxy) getPeerMetadata(id string) *PeerMetadata {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+
+	return proxy.peerIds[id].clone()
+}
+
+// Return the number of proxy hops to the given peer id
+func (proxy *Proxy) getPeerHops(id string) int {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+
+	return proxy.peerHops[id]
+}
+
+// Return a snapshot of the peer ids this proxy connection owns
+func (proxy *Proxy) getPeerIds() []string {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+
+	peerIds := make([]string, 0, len(proxy.peerIds))
+	for peerId := range proxy.peerIds {
+		peerIds = append(peerIds, peerId)
+	}
+	return peerIds
+}
+
+// Return the number of peer ids this proxy connection owns
+func (proxy *Proxy) countPeerIds() int {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+
+	return len(proxy.peerIds)
 }
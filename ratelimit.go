@@ -0,0 +1,266 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/richtr/websocket"
+)
+
+// RateLimit configures token bucket limits on the messages accepted from a
+// connection or channel. Zero rates disable each limit.
+type RateLimit struct {
+	// Sustained number of messages accepted per second
+	MessagesPerSecond float64
+
+	// Sustained number of payload bytes accepted per second
+	BytesPerSecond float64
+
+	// Number of messages and payload bytes that can be accepted at once above
+	// the sustained rates. Default to one second's worth.
+	MessageBurst int
+	ByteBurst    int
+}
+
+func (limit RateLimit) validate() error {
+	if limit.MessagesPerSecond < 0 || limit.BytesPerSecond < 0 {
+		return errors.New("Rate limits must not be negative")
+	}
+
+	if limit.MessageBurst < 0 || limit.ByteBurst < 0 {
+		return errors.New("Rate limit bursts must not be negative")
+	}
+
+	return nil
+}
+
+// RateLimitPolicy determines what happens to a message that exceeds a rate limit.
+type RateLimitPolicy int
+
+const (
+	// Discard the message.
+	DropThrottledMessage RateLimitPolicy = iota
+
+	// Stop reading from the sender until the message is within the limit.
+	// Messages relayed over proxy links are discarded instead so that one
+	// remote peer cannot stall a link shared with other remote peers.
+	DelayThrottledMessage
+
+	// Discard the message and close the sender's connection. A proxy link
+	// relaying the message is closed and then re-established.
+	DisconnectThrottledSender
+)
+
+/** Token bucket rate limiting **/
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+}
+
+// Create a token bucket for the given rate. Returns nil if rate is zero.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+
+	return &tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+func (bucket *tokenBucket) refill(elapsed time.Duration) {
+	bucket.tokens += elapsed.Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+}
+
+// Time until n tokens (or a full bucket for n larger than the burst) are available
+func (bucket *tokenBucket) wait(n float64) time.Duration {
+	if n > bucket.burst {
+		n = bucket.burst
+	}
+
+	if bucket.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	// Guards messages, bytes and last
+	mu sync.Mutex
+
+	messages *tokenBucket
+	bytes    *tokenBucket
+
+	last time.Time
+}
+
+// Create a rate limiter for the given limit. Returns nil if the limit is disabled.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	messages := newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst)
+	bytes := newTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+
+	if messages == nil && bytes == nil {
+		return nil
+	}
+
+	return &rateLimiter{messages: messages, bytes: bytes, last: time.Now()}
+}
+
+// Return how long a message of the given size must wait to be within this
+// limit, counting it against the limit if take is set
+func (limiter *rateLimiter) reserve(size int, take bool) time.Duration {
+	if limiter == nil {
+		return 0
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(limiter.last)
+	limiter.last = now
+
+	var delay time.Duration
+	if limiter.messages != nil {
+		limiter.messages.refill(elapsed)
+		if d := limiter.messages.wait(1); d > delay {
+			delay = d
+		}
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.refill(elapsed)
+		if d := limiter.bytes.wait(float64(size)); d > delay {
+			delay = d
+		}
+	}
+
+	if take {
+		if limiter.messages != nil {
+			limiter.messages.tokens--
+		}
+		if limiter.bytes != nil {
+			limiter.bytes.tokens -= float64(size)
+		}
+	}
+
+	return delay
+}
+
+// Return the longest wait for a message of the given size to be within every
+// one of limiters, counting it against each limiter if take is set
+func reserveAll(limiters []*rateLimiter, size int, take bool) time.Duration {
+	var delay time.Duration
+	for _, limiter := range limiters {
+		if d := limiter.reserve(size, take); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// Return the RateLimitPolicy of the service running the given channel
+func rateLimitPolicy(channel *Channel) RateLimitPolicy {
+	if channel.service == nil {
+		return DropThrottledMessage
+	}
+	return channel.service.config.RateLimitPolicy
+}
+
+// Apply the rate limits of this local peer connection and of its channel to
+// an inbound message. Returns whether the message should be processed.
+func (peer *Peer) throttle(message *WireMessage) bool {
+	limiters := []*rateLimiter{peer.limiter, peer.channel.limiter}
+	size := len(message.Payload)
+	policy := rateLimitPolicy(peer.channel)
+
+	// Delayed messages are always counted. Other messages are only counted
+	// once they are within every limit.
+	delay := reserveAll(limiters, size, policy == DelayThrottledMessage)
+
+	if delay == 0 {
+		if policy != DelayThrottledMessage {
+			reserveAll(limiters, size, true)
+		}
+		return true
+	}
+
+	switch policy {
+	case DelayThrottledMessage:
+		peer.reportThrottle(peer.transport, message, peer.id, fmt.Sprintf("Rate limit exceeded. Message delayed by %v.", delay))
+
+		select {
+		case <-time.After(delay):
+		case <-peer.transport.quit:
+		}
+		return true
+
+	case DisconnectThrottledSender:
+		peer.reportThrottle(peer.transport, message, peer.id, "Rate limit exceeded. Disconnecting.")
+		log.Printf("Rate limit exceeded by '%s'. Connection closed.", peer.id)
+
+		// Queue a close frame behind the error message and then stop the
+		// connection so that a sender ignoring the close frame is still cut off
+		peer.transport.Close(websocket.ClosePolicyViolation, "Rate limit exceeded")
+		peer.Stop()
+
+	default:
+		peer.reportThrottle(peer.transport, message, peer.id, "Rate limit exceeded. Message dropped.")
+	}
+
+	return false
+}
+
+// Apply the rate limits of the remote peer that sent a message relayed over
+// this proxy link, and of the channel, to the message. Returns whether the
+// message should be processed. Relayed messages are never delayed.
+func (proxy *Proxy) throttle(message *WireMessage) bool {
+	channel := proxy.base.channel
+	limiters := []*rateLimiter{proxy.getLimiter(message.Source), channel.limiter}
+	size := len(message.Payload)
+
+	if reserveAll(limiters, size, false) == 0 {
+		reserveAll(limiters, size, true)
+		return true
+	}
+
+	transport := proxy.getTransport()
+
+	if rateLimitPolicy(channel) == DisconnectThrottledSender {
+		proxy.base.reportThrottle(transport, message, message.Source, "Rate limit exceeded. Disconnecting.")
+		log.Printf("Rate limit exceeded by '%s'. Proxy connection closed.", message.Source)
+
+		// Close the link instead of stopping the proxy so that a dialed link is
+		// re-established (and an accepted link is re-dialed by its remote end)
+		transport.Close(websocket.ClosePolicyViolation, "Rate limit exceeded")
+		transport.Stop()
+
+		return false
+	}
+
+	proxy.base.reportThrottle(transport, message, message.Source, "Rate limit exceeded. Message dropped.")
+
+	return false
+}
+
+// Send an "error" message explaining a throttled message back to its sender
+func (peer *Peer) reportThrottle(transport *Transport, message *WireMessage, sender string, reason string) {
+	transport.writeWireMessage(&WireMessage{
+		Action: "error",
+		Id:     message.Id,
+		Source: peer.id,
+		Target: sender,
+		Error:  reason,
+	})
+}
@@ -0,0 +1,376 @@
+package networkwebsockets
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/richtr/websocket"
+)
+
+const (
+	// Default delay before the first reconnection attempt of a reconnecting
+	// Client or proxy link.
+	DefaultMinReconnectBackoff = 500 * time.Millisecond
+
+	// Default maximum delay between reconnection attempts of a reconnecting
+	// Client or proxy link.
+	DefaultMaxReconnectBackoff = 30 * time.Second
+)
+
+// ReconnectOptions configures a Client created with DialReconnecting.
+type ReconnectOptions struct {
+	// Delay before the first reconnection attempt. Doubled after each failed
+	// attempt up to MaxBackoff. Each delay is randomly reduced by up to half.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Number of failed reconnection attempts after which the client gives up.
+	// Zero means the client never gives up.
+	MaxAttempts int
+
+	// Number of broadcasts to hold while disconnected and send once
+	// reconnected. The oldest broadcasts are discarded first. Zero disables
+	// buffering.
+	BufferBroadcasts int
+}
+
+type ClientEventType int
+
+const (
+	// The client's connection to its Network Web Socket channel was lost
+	ClientDisconnected ClientEventType = iota
+
+	// A reconnection attempt failed. Another attempt will be made.
+	ClientReconnectFailed
+
+	// The client has reconnected with a new peer id and re-sent a status request
+	ClientReconnected
+
+	// The client gave up reconnecting after ReconnectOptions.MaxAttempts attempts
+	ClientReconnectAbandoned
+)
+
+// ClientEvent reports a change in the connection state of a reconnecting Client.
+type ClientEvent struct {
+	Type ClientEventType
+
+	// Number of reconnection attempts made since the connection was lost
+	Attempt int
+
+	// Reason the last reconnection attempt failed, if any
+	Err error
+}
+
+// Connect to a Network Web Socket channel URL with a Client that re-dials the
+// same URL whenever its connection is lost. Reconnection progress is reported
+// on the client's Events channel.
+func DialReconnecting(urlStr string, handler MessageHandler, options ReconnectOptions) (*Client, *http.Response, error) {
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = DefaultMinReconnectBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = DefaultMaxReconnectBackoff
+		if options.MaxBackoff < options.MinBackoff {
+			options.MaxBackoff = options.MinBackoff
+		}
+	}
+
+	client, httpResp, err := Dial(urlStr, handler)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client.mu.Lock()
+	client.reconnect = &options
+	client.mu.Unlock()
+
+	go client.maintainConnection(urlStr, client.getTransport().handler, &options)
+
+	return client, httpResp, nil
+}
+
+// Wait for the client's connection to be lost and then reconnect it until
+// the client is stopped or reconnection is abandoned
+func (client *Client) maintainConnection(urlStr string, handler MessageHandler, options *ReconnectOptions) {
+	for {
+		transport := client.getTransport()
+
+		select {
+		case <-transport.StopNotify():
+		case <-client.quit:
+			return
+		}
+
+		client.requeue(transport.abandon())
+
+		client.emit(ClientEvent{Type: ClientDisconnected})
+
+		if !client.redial(urlStr, handler, options) {
+			return
+		}
+	}
+}
+
+// Re-dial the client's channel URL with exponential backoff and jitter.
+// Returns whether the client reconnected.
+func (client *Client) redial(urlStr string, handler MessageHandler, options *ReconnectOptions) bool {
+	backoff := options.MinBackoff
+
+	for attempt := 1; options.MaxAttempts == 0 || attempt <= options.MaxAttempts; attempt++ {
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+		select {
+		case <-time.After(delay):
+		case <-client.quit:
+			return false
+		}
+
+		if backoff *= 2; backoff > options.MaxBackoff {
+			backoff = options.MaxBackoff
+		}
+
+		transport, _, err := dialTransport(context.Background(), urlStr, handler)
+		if err != nil {
+			client.emit(ClientEvent{Type: ClientReconnectFailed, Attempt: attempt, Err: err})
+			continue
+		}
+
+		client.mu.Lock()
+		if client.stopped {
+			client.mu.Unlock()
+			transport.conn.Close()
+			return false
+		}
+		client.transport = transport
+		client.id = ""
+		client.markRosterStale()
+		buffered := client.buffered
+		client.buffered = nil
+		client.mu.Unlock()
+
+		transport.Start()
+
+		// Learn this client's new peer id and reconcile its roster
+		client.SendStatusRequest()
+
+		client.publishMetadata()
+
+		for _, message := range buffered {
+			client.send(message)
+		}
+
+		client.emit(ClientEvent{Type: ClientReconnected, Attempt: attempt})
+
+		return true
+	}
+
+	client.emit(ClientEvent{Type: ClientReconnectAbandoned, Attempt: options.MaxAttempts})
+
+	return false
+}
+
+// Hold a broadcast until a reconnecting client reconnects, if enabled
+func (client *Client) buffer(message *WireMessage) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.reconnect == nil || client.reconnect.BufferBroadcasts <= 0 || client.stopped {
+		return
+	}
+
+	if len(client.buffered) >= client.reconnect.BufferBroadcasts {
+		client.buffered[0] = nil // allow to be garbage-collected
+		client.buffered = client.buffered[1:]
+	}
+
+	client.buffered = append(client.buffered, message)
+}
+
+// Recover the messages left unsent on a lost connection. Broadcasts are
+// buffered for the reconnected client and senders waiting on direct messages
+// are told that they were not delivered.
+func (client *Client) requeue(queued []outboundMessage) {
+	reassembler := newReassembler(DefaultMaxReassembledMessageSize, DefaultReassemblyTimeout)
+
+	for _, outbound := range queued {
+		var message WireMessage
+		var err error
+
+		if outbound.messageType == websocket.BinaryMessage {
+			message, err = decodeBinaryWireMessage(outbound.data)
+		} else {
+			message, err = decodeWireMessage(outbound.data)
+		}
+		if err != nil {
+			continue
+		}
+
+		// Messages of which some fragments were already written are lost
+		complete, err := reassembler.add(&message)
+		if err != nil || complete == nil {
+			continue
+		}
+
+		switch complete.Action {
+		case "broadcast":
+			client.buffer(complete)
+		case "message":
+			if complete.Id != "" {
+				client.resolve(complete.Id, WireMessage{
+					Action:  "nack",
+					Id:      complete.Id,
+					Payload: "Connection lost before the message was sent",
+				})
+			}
+		}
+	}
+}
+
+// Report a client event without blocking if nobody is listening
+func (client *Client) emit(event ClientEvent) {
+	select {
+	case client.Events <- event:
+	default:
+	}
+}
+
+/** Proxy link reconnection **/
+
+// ProxyState describes the health of a proxy link to a remote channel.
+type ProxyState int
+
+const (
+	// The proxy link is established.
+	ProxyConnected ProxyState = iota
+
+	// The proxy link was lost and is being re-dialed.
+	ProxyRetrying
+
+	// The proxy link was lost and has been abandoned, or has been stopped.
+	ProxyFailed
+)
+
+// Wait for the websocket of this proxy connection to close. Proxy connections
+// dialed from a DNS-SD record are re-dialed while the remote channel is still
+// advertised. Other proxy connections are stopped.
+func (proxy *Proxy) maintain(transport *Transport) {
+	for {
+		select {
+		case <-transport.StopNotify():
+		case <-proxy.quit:
+			return
+		}
+
+		transport.Stop()
+
+		if !proxy.reconnect() {
+			proxy.Stop()
+			return
+		}
+
+		transport = proxy.getTransport()
+	}
+}
+
+// Re-dial a lost proxy link with exponential backoff and jitter. Returns
+// whether the link was re-established.
+func (proxy *Proxy) reconnect() bool {
+	channel := proxy.base.channel
+
+	proxy.base.mu.Lock()
+	if !proxy.base.active || proxy.record == nil || channel.service == nil {
+		proxy.base.mu.Unlock()
+		return false
+	}
+	proxy.state = ProxyRetrying
+	proxy.base.mu.Unlock()
+
+	log.Printf("Proxy connection to '%s' channel peer lost. Reconnecting...", channel.serviceName)
+
+	// Remote peers are unreachable until the link is re-established
+	proxy.dropPeerIds()
+
+	config := &channel.service.config
+	backoff := config.ProxyMinReconnectBackoff
+
+	for attempt := 1; config.ProxyMaxReconnectAttempts == 0 || attempt <= config.ProxyMaxReconnectAttempts; attempt++ {
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+		select {
+		case <-time.After(delay):
+		case <-proxy.quit:
+			return false
+		}
+
+		if backoff *= 2; backoff > config.ProxyMaxReconnectBackoff {
+			backoff = config.ProxyMaxReconnectBackoff
+		}
+
+		// Give up once the remote channel is no longer advertised
+		record := channel.service.lookupAdvertisedRecord(proxy.Hash_Base64)
+		if record == nil || channel.isClosed() {
+			break
+		}
+
+		ws, err := dialProxyWebSocket(record, channel)
+		if err == errDuplicateProxy {
+			// The remote channel still holds a link that it dialed to this
+			// channel. Wait for it to go without counting a failed attempt.
+			attempt--
+			continue
+		}
+		if err != nil {
+			log.Printf("err: %v", err)
+			continue
+		}
+
+		return proxy.resume(ws, record)
+	}
+
+	proxy.base.mu.Lock()
+	proxy.state = ProxyFailed
+	proxy.base.mu.Unlock()
+
+	log.Printf("Proxy connection to '%s' channel peer could not be re-established", channel.serviceName)
+
+	return false
+}
+
+// Continue this proxy connection over a newly dialed websocket and re-sync
+// the peer connections known at each end. Returns false if the proxy
+// connection was stopped in the meantime.
+func (proxy *Proxy) resume(ws *websocket.Conn, record *DNSRecord) bool {
+	channel := proxy.base.channel
+	config := &channel.service.config
+
+	transport := NewTransport(ws, &ProxyMessageHandler{proxy})
+	transport.configure(config, config.ProxyMaxMessageSize)
+
+	proxy.base.mu.Lock()
+	if !proxy.base.active {
+		proxy.base.mu.Unlock()
+		ws.Close()
+		return false
+	}
+	proxy.base.transport = transport
+	proxy.record = record
+	proxy.state = ProxyConnected
+	proxy.base.mu.Unlock()
+
+	transport.Start()
+
+	// Stop the new transport if .Stop() was called before it started
+	if !proxy.base.isActive() {
+		transport.Stop()
+		return false
+	}
+
+	// The remote service announces its peer connections to us as it accepts
+	// the new websocket
+	proxy.announce(channel.getPeers())
+
+	return true
+}
@@ -0,0 +1,96 @@
+package networkwebsockets
+
+import (
+	"context"
+	"errors"
+)
+
+// Returned by Client.Request when the target peer could not be found
+var ErrUnknownTarget = errors.New("Request target could not be found")
+
+// RequestHandler serves a request received by a Client. The returned payload
+// is sent back to the requesting peer as the reply, or the message of the
+// returned error if it is not nil.
+type RequestHandler func(request WireMessage) (string, error)
+
+// Set the handler that serves requests sent to this client with .Request().
+// Requests received while no handler is set are passed to the Message channel.
+func (client *Client) HandleRequests(handler RequestHandler) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.requestHandler = handler
+}
+
+// Send a request to the peer with the given id and wait for its reply.
+// Returns ErrUnknownTarget if the target peer could not be found,
+// ErrPeerDisconnected if it disconnects before replying or the context's
+// error if ctx is done first.
+func (client *Client) Request(ctx context.Context, targetId string, payload string) (string, error) {
+	if targetId == "" {
+		return "", errors.New("Request must have a target identifier")
+	}
+
+	request := &WireMessage{
+		Action:  "message",
+		Id:      GenerateId(),
+		Request: true,
+		Target:  targetId,
+		Payload: payload,
+	}
+
+	pending := client.await(request.Id, targetId, true)
+	defer client.forget(request.Id)
+
+	client.send(request)
+
+	select {
+	case reply := <-pending.result:
+		switch reply.Action {
+		case "nack":
+			return "", ErrUnknownTarget
+		case "disconnect":
+			return "", ErrPeerDisconnected
+		}
+		if reply.Error != "" {
+			return "", errors.New(reply.Error)
+		}
+		return reply.Payload, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-client.quit:
+		return "", errClientStopped
+	}
+}
+
+// Serve a request with the registered request handler, if any. Returns
+// whether the request was handled.
+func (client *Client) serveRequest(request WireMessage) bool {
+	client.mu.Lock()
+	handler := client.requestHandler
+	client.mu.Unlock()
+
+	if handler == nil {
+		return false
+	}
+
+	// Serve outside of the read pump so slow handlers do not block it
+	go func() {
+		reply := &WireMessage{
+			Action:  "message",
+			Target:  request.Source,
+			ReplyTo: request.Id,
+		}
+
+		payload, err := handler(request)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Payload = payload
+		}
+
+		client.send(reply)
+	}()
+
+	return true
+}
@@ -0,0 +1,168 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"sort"
+)
+
+// Return a sorted snapshot of the ids of the other peers connected to this
+// client's channel, including peers connected via other Network Web Socket
+// Proxies. Changes are notified as "connect" and "disconnect" messages.
+func (client *Client) Peers() []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	peerIds := make([]string, 0, len(client.roster)+len(client.staleRoster))
+	for peerId := range client.roster {
+		peerIds = append(peerIds, peerId)
+	}
+	for peerId := range client.staleRoster {
+		peerIds = append(peerIds, peerId)
+	}
+	sort.Strings(peerIds)
+
+	return peerIds
+}
+
+// Whether the peer with the given id is connected to this client's channel
+func (client *Client) Has(id string) bool {
+	_, ok := client.PeerMetadata(id)
+	return ok
+}
+
+// Return the metadata published by the peer with the given id and whether
+// that peer is connected to this client's channel. Changes are notified as
+// "update" messages.
+func (client *Client) PeerMetadata(id string) (PeerMetadata, bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	metadata, ok := client.roster[id]
+	if !ok {
+		metadata, ok = client.staleRoster[id]
+	}
+
+	if metadata == nil {
+		return PeerMetadata{}, ok
+	}
+	return *metadata.clone(), ok
+}
+
+// Publish new metadata for this client to the other peers of its channel.
+// A reconnecting client publishes it again after each reconnect.
+func (client *Client) SetMetadata(metadata PeerMetadata) error {
+	if err := metadata.validate(); err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	client.metadata = metadata.clone()
+	client.mu.Unlock()
+
+	return client.publishMetadata()
+}
+
+// Send this client's metadata to its channel, if it has any
+func (client *Client) publishMetadata() error {
+	client.mu.Lock()
+	metadata := client.metadata.clone()
+	client.mu.Unlock()
+
+	if metadata == nil {
+		return nil
+	}
+
+	transport := client.getTransport()
+	if !transport.isOpen() {
+		return errors.New("Client is not active")
+	}
+
+	return transport.writeWireMessage(&WireMessage{Action: "update", Metadata: metadata})
+}
+
+// Record that a peer has connected. Returns whether the peer was not already
+// known.
+func (client *Client) addToRoster(id string, metadata *PeerMetadata) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if _, ok := client.roster[id]; ok {
+		return false
+	}
+
+	client.roster[id] = metadata.clone()
+
+	// Peers known before a reconnect are not new
+	if _, ok := client.staleRoster[id]; ok {
+		delete(client.staleRoster, id)
+		return false
+	}
+
+	return true
+}
+
+// Record new metadata published by a peer. Returns whether the peer is known.
+func (client *Client) updateRoster(id string, metadata *PeerMetadata) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if _, ok := client.roster[id]; ok {
+		client.roster[id] = metadata.clone()
+		return true
+	}
+
+	if _, ok := client.staleRoster[id]; ok {
+		client.staleRoster[id] = metadata.clone()
+		return true
+	}
+
+	return false
+}
+
+// Record that a peer has disconnected. Returns whether the peer was known.
+func (client *Client) removeFromRoster(id string) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	_, known := client.roster[id]
+	if _, ok := client.staleRoster[id]; ok {
+		known = true
+	}
+
+	delete(client.roster, id)
+	delete(client.staleRoster, id)
+
+	return known
+}
+
+// Mark all known peers as needing to be confirmed after a reconnect. Must be
+// called with client.mu held.
+func (client *Client) markRosterStale() {
+	for peerId, metadata := range client.roster {
+		client.staleRoster[peerId] = metadata
+	}
+	client.roster = make(map[string]*PeerMetadata)
+}
+
+// Reconcile peers known before a reconnect with the peer ids reported in a
+// "status" reply. Returns the ids of the peers that disconnected while this
+// client was disconnected.
+func (client *Client) reconcileRoster(peerIds []string) []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for _, peerId := range peerIds {
+		if metadata, ok := client.staleRoster[peerId]; ok {
+			delete(client.staleRoster, peerId)
+			client.roster[peerId] = metadata
+		}
+	}
+
+	var departed []string
+	for peerId := range client.staleRoster {
+		departed = append(departed, peerId)
+	}
+	client.staleRoster = make(map[string]*PeerMetadata)
+
+	return departed
+}
@@ -1,36 +1,52 @@
 package networkwebsockets
 
 import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/base32"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	tls "github.com/richtr/go-tls-srp"
+	"github.com/richtr/websocket"
 )
 
 var (
 	// Proxy path matchers
 	serviceNameRegexStr  = "[A-Za-z0-9\\+=\\*\\._-]{1,255}"
 	isValidCreateRequest = regexp.MustCompile(fmt.Sprintf("^/%s$", serviceNameRegexStr))
-	isValidProxyRequest  = regexp.MustCompile(fmt.Sprintf("^/%s$", serviceNameRegexStr))
+	isValidProxyRequest  = regexp.MustCompile(fmt.Sprintf("^/%s$", idRegexStr))
 
-	// TLS-SRP configuration components
-	Salt       = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
-	serviceTab = CredentialsStore(map[string]string{})
+	// Identifier format and encoding produced by GenerateId
+	idRegexStr = "[a-z2-7]{26}"
+	idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
 )
 
-// Generate a new random identifier
+// Request header in which a dialing proxy connection identifies the channel it
+// links from by its service hash
+const proxyServiceHashHeader = "X-Nws-Service-Hash"
+
+// Generate a new random identifier: 128 bits from crypto/rand encoded as 26
+// lower-case base32 characters
 func GenerateId() string {
-	rand.Seed(time.Now().UTC().UnixNano())
-	return fmt.Sprintf("%d", rand.Int())
+	b := make([]byte, 16)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(fmt.Sprintf("Could not generate a random identifier: %v", err))
+	}
+
+	return strings.ToLower(idEncoding.EncodeToString(b))
 }
 
 type HTTPHandler interface {
@@ -51,7 +67,8 @@ func (sh *DefaultServiceHandler) ServeLocalRequest(w http.ResponseWriter, r *htt
 	}
 
 	// Only allow access from localhost to all services
-	if isRequestFromLocalHost := service.checkRequestIsFromLocalHost(r.Host); !isRequestFromLocalHost {
+	if err := service.checkLocalRequest(r); err != nil {
+		log.Printf("Security: refused local request from %s for host '%s': %v", r.RemoteAddr, r.Host, err)
 		http.Error(w, fmt.Sprintln("This interface is only accessible from the local machine"), 403)
 		return
 	}
@@ -94,14 +111,53 @@ func (sh *DefaultServiceHandler) ServeLocalRequest(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// Resolve to network web socket channel
-	channel := service.GetChannelByName(serviceName)
-	if channel == nil {
-		channel = NewChannel(service, serviceName)
+	// Only allow web pages whose origin the service's policy accepts
+	origin := r.Header.Get("Origin")
+	if err := service.config.OriginPolicy.check(origin, serviceName); err != nil {
+		log.Printf("Security: refused '%s' channel connection from origin '%s': %v", serviceName, origin, err)
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	// Require a bearer token for this channel when token authentication is enabled
+	if tokens := service.config.Tokens; tokens != nil {
+		if err := tokens.authorize(requestToken(r), serviceName); err != nil {
+			log.Printf("Security: refused '%s' channel connection from %s: %v", serviceName, r.RemoteAddr, err)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+	}
+
+	// Refuse peers that would exceed the channel's limit
+	peers := 0
+	if channel := service.GetChannelByName(serviceName); channel != nil {
+		peers = channel.countPeers()
+	}
+
+	if maxPeers := service.config.maxPeers(serviceName); maxPeers > 0 && peers >= maxPeers {
+		log.Printf("Refused '%s' channel connection from %s: %v", serviceName, r.RemoteAddr, errChannelFull)
+		http.Error(w, errChannelFull.Error(), 503)
+		return
+	}
+
+	// Let the embedding application veto this peer
+	if admitPeer := service.config.AdmitPeer; admitPeer != nil {
+		if err := admitPeer(newAdmissionRequest(r, serviceName, peers)); err != nil {
+			log.Printf("Refused '%s' channel connection from %s: %v", serviceName, r.RemoteAddr, err)
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+	}
+
+	// Read the metadata this peer publishes on join, if any
+	metadata, err := parsePeerMetadata(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
 
 	// Serve network web socket channel peer
-	ws, err := upgradeHTTPToWebSocket(w, r)
+	ws, err := upgradeHTTPToWebSocket(w, r, &service.config)
 	if err != nil {
 		http.Error(w, "Bad Request", 400)
 		return
@@ -109,7 +165,35 @@ func (sh *DefaultServiceHandler) ServeLocalRequest(w http.ResponseWriter, r *htt
 
 	// Create, bind and start a new peer connection
 	peer := NewPeer(ws)
-	peer.Start(channel)
+	peer.setMetadata(metadata)
+
+	for {
+		// Resolve to network web socket channel
+		channel, created := service.getOrCreateChannel(serviceName)
+
+		// Retry if the channel was stopped before the peer could join it
+		err := peer.Start(channel)
+		if err == errChannelClosed {
+			continue
+		}
+
+		// The channel filled up while this peer's connection was upgraded
+		if err != nil {
+			log.Printf("Refused '%s' channel connection from %s: %v", serviceName, r.RemoteAddr, err)
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(service.config.WriteWait))
+			ws.Close()
+			break
+		}
+
+		// Only link a new channel to the remote channels discovered before it
+		// existed once its first peer has been admitted, so that their remote
+		// peers can never fill the channel up and leave it without local peers
+		if created {
+			channel.dialCachedRecords()
+		}
+
+		break
+	}
 }
 
 func (sh *DefaultServiceHandler) ServeProxyRequest(w http.ResponseWriter, r *http.Request) {
@@ -142,24 +226,46 @@ func (sh *DefaultServiceHandler) ServeProxyRequest(w http.ResponseWriter, r *htt
 	}
 
 	// Resolve servicePath to an active named websocket service
-	for _, channel := range service.Channels {
-		if channel.proxyPath == r.URL.Path {
-			ws, err := upgradeHTTPToWebSocket(w, r)
-			if err != nil {
-				http.Error(w, "Bad Request", 400)
-				return
-			}
+	channel := service.getChannelByProxyPath(r.URL.Path)
+	if channel == nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
 
-			// Create, bind and start a new proxy connection
-			proxy := NewProxy(ws, true)
-			proxy.Start(channel)
+	// Only allow TLS-SRP sessions established for this channel to reach its proxy path
+	srpUser := proxyRequestSRPUser(r)
+	if err := service.authorizeProxyRequest(srpUser, channel); err != nil {
+		log.Printf("Security: refused proxy connection from %s authenticated as '%s' to %s: %v", r.RemoteAddr, srpUser, r.URL.Path, err)
+		http.Error(w, "Forbidden", 403)
+		return
+	}
 
-			return
-		}
+	// Keep a single proxy link to each remote channel. A remote channel that
+	// dials again has lost the link it dialed before, even if this end has not
+	// noticed yet, so that link is replaced.
+	remoteHash := r.Header.Get(proxyServiceHashHeader)
+	if stale := channel.getAcceptedProxy(remoteHash); stale != nil {
+		log.Printf("Replacing stale proxy connection from '%s' channel peer", channel.serviceName)
+		stale.Stop()
+	}
+
+	if channel.isLinkedTo(remoteHash) {
+		http.Error(w, errDuplicateProxy.Error(), 409)
+		return
+	}
+
+	ws, err := upgradeHTTPToWebSocket(w, r, &service.config)
+	if err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
 	}
 
-	http.Error(w, "Not Found", 404)
-	return
+	// Create, bind and start a new proxy connection
+	proxy := NewProxy(ws, true)
+	proxy.setHash_Base64(remoteHash)
+	if err := proxy.Start(channel); err != nil {
+		ws.Close()
+	}
 }
 
 type Service struct {
@@ -170,40 +276,76 @@ type Service struct {
 
 	Handler HTTPHandler
 
+	// Guards Channels, ProxyPort, discoveryBrowser, done and listeners
+	mu sync.RWMutex
+
 	// All Network Web Socket channels that this service manages
 	Channels map[string]*Channel
 
+	// Configuration parameters for this service
+	config ServiceConfig
+
+	// TLS-SRP credentials of this service's channels
+	credentials CredentialsStore
+
 	discoveryBrowser *DiscoveryBrowser
 
-	done chan int // blocks until .Stop() is called on this service
+	done chan int // closed when .Stop() or .Shutdown() is called on this service
 
 	localListener net.Listener
+	unixListener  net.Listener
 	netListener   net.Listener
 }
 
+// Create a new Service with default configuration on the given host and port.
+// DefaultPort is used if port is out of range. Returns nil if the host name of
+// this device cannot be determined.
 func NewService(host string, port int) *Service {
-	if host == "" {
-		hostname, err := os.Hostname()
-		if err != nil {
-			log.Printf("Could not determine device hostname: %v\n", err)
-			return nil
-		}
-		host = hostname
+	config := DefaultServiceConfig()
+	config.Host = host
+
+	if port > 1024 && port < 65534 {
+		config.Port = port
 	}
 
-	if port <= 1024 || port >= 65534 {
-		port = 9009
+	service, err := NewServiceWithConfig(config)
+	if err != nil {
+		log.Printf("Could not create service: %v\n", err)
+		return nil
+	}
+
+	return service
+}
+
+// Create a new Service with the given configuration. An error is returned if
+// the configuration is not valid.
+func NewServiceWithConfig(config ServiceConfig) (*Service, error) {
+	if err := config.resolveHost(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	credentials := config.CredentialsStore
+	if credentials == nil {
+		credentials = NewMemoryCredentialsStore()
 	}
 
 	service := &Service{
-		Host: host,
-		Port: port,
+		Host: config.Host,
+		Port: config.Port,
 
 		ProxyPort: 0,
 
 		Channels: make(map[string]*Channel),
 
-		discoveryBrowser: NewDiscoveryBrowser(),
+		config: config,
+
+		credentials: credentials,
+
+		discoveryBrowser: NewDiscoveryBrowser(config.DiscoveryPort),
 
 		done: make(chan int),
 	}
@@ -211,23 +353,60 @@ func NewService(host string, port int) *Service {
 	// Setup a new default http service handler
 	service.Handler = &DefaultServiceHandler{service}
 
-	return service
+	return service, nil
+}
+
+// Issue a bearer token to a local application that may join the given channel
+// names or patterns (or every channel if none are given)
+func (service *Service) IssueToken(app string, channels ...string) (string, error) {
+	if service.config.Tokens == nil {
+		return "", errors.New("Token authentication is not enabled for this service")
+	}
+
+	return service.config.Tokens.Issue(app, channels...)
 }
 
-func (service *Service) Start() <-chan int {
+// Config returns a copy of the configuration used by this service.
+func (service *Service) Config() ServiceConfig { return service.config }
+
+// Start all the servers required by this service. If any of them cannot be
+// started then the servers that were already started are closed again and an
+// error is returned, leaving the service in a state where Start can be retried.
+func (service *Service) Start() (<-chan int, error) {
+	// Replace the stop notification channel closed by a previous .Stop()
+	service.mu.Lock()
+	select {
+	case <-service.done:
+		service.done = make(chan int)
+	default:
+	}
+	service.mu.Unlock()
+
 	// Start HTTP/Network Web Socket creation server
-	service.StartHTTPServer()
+	if err := service.StartHTTPServer(); err != nil {
+		return nil, err
+	}
 
 	// Start TLS-SRP Network Web Socket (wss) proxy server
-	service.StartProxyServer()
+	if err := service.StartProxyServer(); err != nil {
+		service.closeListeners()
+		return nil, err
+	}
 
 	// Start mDNS/DNS-SD Network Web Socket discovery service
-	service.StartDiscoveryBrowser(10)
+	service.StartDiscoveryBrowser(int(service.config.BrowseTimeout / time.Second))
 
-	return service.StopNotify()
+	return service.StopNotify(), nil
 }
 
-func (service *Service) StartHTTPServer() {
+func (service *Service) StartHTTPServer() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.localListener != nil {
+		return errors.New("HTTP server is already started")
+	}
+
 	// Create a new custom http server multiplexer
 	serveMux := http.NewServeMux()
 
@@ -237,72 +416,125 @@ func (service *Service) StartHTTPServer() {
 	// Listen and on loopback address + port
 	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", service.Port))
 	if err != nil {
-		log.Fatal("Could not serve web server. ", err)
+		return fmt.Errorf("Could not serve web server. %v", err)
+	}
+
+	var unixListener net.Listener
+	if service.config.UnixSocketPath != "" {
+		unixListener, err = listenPrivateUnix(service.config.UnixSocketPath)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("Could not serve web server on Unix socket. %v", err)
+		}
 	}
 
 	service.localListener = listener
+	service.unixListener = unixListener
 
 	log.Printf("Serving Network Web Socket Creator Proxy at address [ ws://localhost:%d/ ]", service.Port)
 
-	go http.Serve(listener, serveMux)
+	server := &http.Server{
+		Handler: serveMux,
+
+		// Make each connection available to request handlers so that the
+		// remote address can be checked
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, localConnContextKey, c)
+		},
+	}
+
+	go server.Serve(listener)
+
+	if unixListener != nil {
+		log.Printf("Serving Network Web Socket Creator Proxy on Unix socket [ %s ]", service.config.UnixSocketPath)
+
+		go server.Serve(unixListener)
+	}
+
+	return nil
 }
 
-func (service *Service) StartProxyServer() {
+func (service *Service) StartProxyServer() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.netListener != nil {
+		return errors.New("Proxy server is already started")
+	}
+
 	// Create a new custom http server multiplexer
 	serveMux := http.NewServeMux()
 
 	// Serve secure network web socket proxy endpoints for network clients
 	serveMux.HandleFunc("/", service.Handler.ServeProxyRequest)
 
-	// Generate random server salt for use in TLS-SRP data storage
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]rune, 32)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	srpSaltKey := string(b)
+	// Generate random server key used to derive salts for unknown TLS-SRP usernames
+	srpSaltKey := GenerateId() + GenerateId()
 
 	tlsServerConfig := &tls.Config{
-		SRPLookup:   serviceTab,
+		SRPLookup:   &srpLookup{service},
 		SRPSaltKey:  srpSaltKey,
-		SRPSaltSize: len(Salt),
+		SRPSaltSize: srpSaltSize,
 	}
 
 	// Listen on all addresses + port
 	tlsSrpListener, err := tls.Listen("tcp", ":0", tlsServerConfig)
 	if err != nil {
-		log.Fatal("Could not serve proxy server. ", err)
+		return fmt.Errorf("Could not serve proxy server. %v", err)
 	}
 
-	service.netListener = tlsSrpListener
-
 	// Obtain and store the port of the proxy endpoint
 	_, port, err := net.SplitHostPort(tlsSrpListener.Addr().String())
 	if err != nil {
-		log.Fatal("Could not determine bound port of proxy server. ", err)
+		tlsSrpListener.Close()
+		return fmt.Errorf("Could not determine bound port of proxy server. %v", err)
 	}
 
+	service.netListener = tlsSrpListener
+
 	service.ProxyPort, _ = strconv.Atoi(port)
 
 	log.Printf("Serving Network Web Socket Network Proxy at address [ wss://%s:%d/ ]", service.Host, service.ProxyPort)
 
-	go http.Serve(tlsSrpListener, serveMux)
+	server := &http.Server{
+		Handler: serveMux,
+
+		// Make each TLS-SRP connection available to request handlers
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, proxyConnContextKey, c)
+		},
+	}
+
+	go server.Serve(tlsSrpListener)
+
+	return nil
 }
 
 func (service *Service) StartDiscoveryBrowser(timeoutSeconds int) {
+	// Replace a discovery browser that was closed by a previous .Stop()
+	service.mu.Lock()
+	if service.discoveryBrowser == nil || service.discoveryBrowser.isClosed() {
+		service.discoveryBrowser = NewDiscoveryBrowser(service.config.DiscoveryPort)
+	}
+	discoveryBrowser := service.discoveryBrowser
+	service.mu.Unlock()
+
 	log.Printf("Listening for Network Web Socket services on the local network...")
 
 	go func() {
-		defer service.discoveryBrowser.Shutdown()
+		defer discoveryBrowser.Shutdown()
 
-		for !service.discoveryBrowser.closed {
-			service.discoveryBrowser.Browse(service, timeoutSeconds)
+		for !discoveryBrowser.isClosed() {
+			discoveryBrowser.Browse(service, timeoutSeconds)
 		}
 	}()
 }
 
 // Check whether we know the given service name
 func (service *Service) GetChannelByName(serviceName string) *Channel {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
 	for _, channel := range service.Channels {
 		if channel.serviceName == serviceName {
 			return channel
@@ -311,9 +543,94 @@ func (service *Service) GetChannelByName(serviceName string) *Channel {
 	return nil
 }
 
+// Resolve the given service name to an active channel, creating and starting
+// a new channel if none exists. Returns whether the channel was created.
+func (service *Service) getOrCreateChannel(serviceName string) (*Channel, bool) {
+	if channel := service.GetChannelByName(serviceName); channel != nil && !channel.isClosed() {
+		return channel, false
+	}
+
+	// Build the channel outside of the lock since hashing its name is slow
+	channel := newChannel(service, serviceName)
+
+	service.mu.Lock()
+	if existing := service.Channels[channel.servicePath]; existing != nil && !existing.isClosed() {
+		service.mu.Unlock()
+		return existing, false
+	}
+	service.Channels[channel.servicePath] = channel
+	service.mu.Unlock()
+
+	channel.start()
+
+	return channel, true
+}
+
+// Find the channel that is advertised on the given proxy path
+func (service *Service) getChannelByProxyPath(proxyPath string) *Channel {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	for _, channel := range service.Channels {
+		if channel.proxyPath == proxyPath {
+			return channel
+		}
+	}
+	return nil
+}
+
+// Find the channel that uses the given base64 hash as its TLS-SRP username
+func (service *Service) getChannelByHash(serviceHash string) *Channel {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	for _, channel := range service.Channels {
+		if channel.serviceHash == serviceHash {
+			return channel
+		}
+	}
+	return nil
+}
+
+// Remove a stopped channel from this service
+func (service *Service) removeChannel(channel *Channel) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.Channels[channel.servicePath] == channel {
+		delete(service.Channels, channel.servicePath)
+	}
+}
+
+// Return a snapshot of the channels this service manages
+func (service *Service) getChannels() []*Channel {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	channels := make([]*Channel, 0, len(service.Channels))
+	for _, channel := range service.Channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func (service *Service) getProxyPort() int {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	return service.ProxyPort
+}
+
+func (service *Service) getDiscoveryBrowser() *DiscoveryBrowser {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	return service.discoveryBrowser
+}
+
 // Check whether a DNS-SD derived Network Web Socket hash is owned by the current proxy instance
 func (service *Service) isOwnProxyService(serviceRecord *DNSRecord) bool {
-	for _, channel := range service.Channels {
+	for _, channel := range service.getChannels() {
 		if channel.serviceHash == serviceRecord.Hash_Base64 {
 			return true
 		}
@@ -323,8 +640,8 @@ func (service *Service) isOwnProxyService(serviceRecord *DNSRecord) bool {
 
 // Check whether a DNS-SD derived Network Web Socket hash is currently connected as a service
 func (service *Service) isActiveProxyService(serviceRecord *DNSRecord) bool {
-	for _, channel := range service.Channels {
-		for _, proxy := range channel.proxies {
+	for _, channel := range service.getChannels() {
+		for _, proxy := range channel.getProxies() {
 			if proxy.Hash_Base64 == serviceRecord.Hash_Base64 {
 				return true
 			}
@@ -333,59 +650,190 @@ func (service *Service) isActiveProxyService(serviceRecord *DNSRecord) bool {
 	return false
 }
 
+// Return the most recently discovered DNS-SD record advertising the remote
+// channel with the given base64 hash, or nil if it is no longer advertised
+func (service *Service) lookupAdvertisedRecord(hash string) *DNSRecord {
+	if discoveryBrowser := service.getDiscoveryBrowser(); discoveryBrowser != nil {
+		return discoveryBrowser.lookupAdvertisedRecord(hash)
+	}
+	return nil
+}
+
 // Stop stops the server gracefully, and shuts down the running goroutine.
-// Stop should be called after a Start(s), otherwise it will block forever.
+// It is equivalent to calling Shutdown without a deadline.
 func (service *Service) Stop() {
-	if service.discoveryBrowser != nil {
-		service.discoveryBrowser.closed = true
+	service.Shutdown(context.Background())
+}
+
+// Shutdown gracefully shuts down the service. It stops accepting new
+// connections, unregisters all advertised channels from the network, waits
+// for queued broadcast messages to be dispatched and sends a close frame to
+// every peer and proxy connection in every channel.
+//
+// Shutdown returns when all channels have been stopped or when ctx expires,
+// in which case the context's error is returned. Channels continue to be
+// stopped in the background after ctx has expired.
+func (service *Service) Shutdown(ctx context.Context) error {
+	if discoveryBrowser := service.getDiscoveryBrowser(); discoveryBrowser != nil {
+		discoveryBrowser.Shutdown()
 	}
 
+	// Stop accepting new connections
+	service.closeListeners()
+
+	// Channels remove themselves from service.Channels as they stop
+	channels := service.getChannels()
+
+	stopped := make(chan int)
+
+	go func() {
+		for _, channel := range channels {
+			channel.shutdown(websocket.CloseGoingAway, "Network Web Socket service is shutting down")
+		}
+		close(stopped)
+	}()
+
+	var err error
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Notify any listeners that this service has stopped
+	service.mu.Lock()
+	select {
+	case <-service.done:
+	default:
+		close(service.done)
+	}
+	service.mu.Unlock()
+
+	return err
+}
+
+// Close any open listeners so that they can be started again
+func (service *Service) closeListeners() {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
 	if service.localListener != nil {
 		service.localListener.Close()
+		service.localListener = nil
+	}
+
+	if service.unixListener != nil {
+		service.unixListener.Close()
+		service.unixListener = nil
+
+		os.Remove(service.config.UnixSocketPath)
 	}
 
 	if service.netListener != nil {
 		service.netListener.Close()
+		service.netListener = nil
 	}
 
-	service.done <- 1
+	service.ProxyPort = 0
 }
 
-// StopNotify returns a channel that receives a empty integer
-// when the server is stopped.
-func (service *Service) StopNotify() <-chan int { return service.done }
+// StopNotify returns a channel that is closed when the server is stopped.
+func (service *Service) StopNotify() <-chan int {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	return service.done
+}
 
 //
 // HELPER FUNCTIONS
 //
 
-func (service *Service) checkRequestIsFromLocalHost(host string) bool {
-	allowedLocalHosts := map[string]bool{
-		fmt.Sprintf("localhost:%d", service.Port):        true,
-		fmt.Sprintf("127.0.0.1:%d", service.Port):        true,
-		fmt.Sprintf("::1:%d", service.Port):              true,
-		fmt.Sprintf("%s:%d", service.Host, service.Port): true,
+// Context key under which the connection of a localhost endpoint request is stored
+type localConnContextKeyType struct{}
+
+var localConnContextKey = localConnContextKeyType{}
+
+// Check that a request to the localhost endpoint arrived over a loopback or
+// Unix socket connection and names an allowed host
+func (service *Service) checkLocalRequest(r *http.Request) error {
+	conn, _ := r.Context().Value(localConnContextKey).(net.Conn)
+
+	switch conn.(type) {
+	case *net.UnixConn:
+		// Unix sockets cannot be reached by web pages so Host is not checked
+		return nil
+	case nil:
+		// Fall back to the request's remote address when served by another server
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("Remote address %s is not a loopback address", r.RemoteAddr)
+		}
+	default:
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !addr.IP.IsLoopback() {
+			return fmt.Errorf("Remote address %s is not a loopback address", conn.RemoteAddr())
+		}
 	}
 
-	if allowedLocalHosts[host] {
-		return true
+	// Refuse hosts that a DNS rebinding attack could have pointed at us
+	if !service.isAllowedLocalHost(r.Host) {
+		return errors.New("Host is not allowed")
 	}
 
-	return false
+	return nil
 }
 
-/** Simple in-memory storage table for TLS-SRP usernames/passwords **/
+// Listen on a Unix socket at path that only the current user may connect to.
+// The socket is created and restricted inside a private directory before it is
+// linked into place so that other users can never reach it.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".nws-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "socket")
 
-type CredentialsStore map[string]string
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
 
-func (cs CredentialsStore) Lookup(user string) (v, s []byte, grp tls.SRPGroup, err error) {
-	grp = tls.SRPGroup4096
+	// The socket is removed from path when the service stops listening
+	listener.SetUnlinkOnClose(false)
 
-	p := cs[user]
-	if p == "" {
-		return nil, nil, grp, nil
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
 	}
 
-	v = tls.SRPVerifier(user, p, Salt, grp)
-	return v, Salt, grp, nil
+	// Fails if path already exists
+	if err := os.Link(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Whether the given Host header value names this service's localhost endpoint
+func (service *Service) isAllowedLocalHost(host string) bool {
+	host = strings.ToLower(host)
+
+	allowedLocalHosts := []string{
+		fmt.Sprintf("localhost:%d", service.Port),
+		fmt.Sprintf("127.0.0.1:%d", service.Port),
+		fmt.Sprintf("[::1]:%d", service.Port),
+	}
+
+	for _, allowedHost := range append(allowedLocalHosts, service.config.AllowedHosts...) {
+		if host == strings.ToLower(allowedHost) {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,183 @@
+package networkwebsockets
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefix of the websocket subprotocol that carries a bearer token
+// (e.g. "nws-token.<token>") for clients that cannot set request headers
+const tokenSubprotocolPrefix = "nws-token."
+
+// LocalToken authorizes a native application to join channels through the
+// localhost endpoint
+type LocalToken struct {
+	// Name of the application this token was issued to
+	App string `json:"app"`
+
+	Token string `json:"token"`
+
+	// Channel names or '*' patterns (e.g. "chat-*") this token may join.
+	// Empty to allow every channel.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// TokenStore holds the bearer tokens issued to local applications in a JSON
+// file readable only by the current user. Applications read their token from
+// this file and present it when joining a channel.
+type TokenStore struct {
+	path string
+
+	// Guards tokens and writes to the file
+	mu     sync.Mutex
+	tokens []*LocalToken
+}
+
+// Open the token file at path, creating it when the first token is issued
+func NewTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read token file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &store.tokens); err != nil {
+		return nil, fmt.Errorf("Could not parse token file: %v", err)
+	}
+
+	return store, nil
+}
+
+// Issue a new token to the given application that may join the given channel
+// names or patterns (or every channel if none are given). Any token previously
+// issued to the application is replaced.
+func (store *TokenStore) Issue(app string, channels ...string) (string, error) {
+	if app == "" {
+		return "", errors.New("Tokens must be issued to a named application")
+	}
+
+	token := &LocalToken{
+		App:      app,
+		Token:    GenerateId() + GenerateId(),
+		Channels: channels,
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.tokens = append(store.removeToken(app), token)
+
+	if err := store.save(); err != nil {
+		return "", err
+	}
+
+	return token.Token, nil
+}
+
+// Revoke the token issued to the given application
+func (store *TokenStore) Revoke(app string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.tokens = store.removeToken(app)
+
+	return store.save()
+}
+
+// Return the tokens without the one issued to app. Must be called with store.mu held.
+func (store *TokenStore) removeToken(app string) []*LocalToken {
+	tokens := make([]*LocalToken, 0, len(store.tokens))
+	for _, token := range store.tokens {
+		if token.App != app {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Atomically replace the token file. Must be called with store.mu held.
+func (store *TokenStore) save() error {
+	data, err := json.MarshalIndent(store.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("Could not write token file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Could not write token file: %v", err)
+	}
+
+	return nil
+}
+
+// Find the token matching the given value
+func (store *TokenStore) lookup(value string) *LocalToken {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var found *LocalToken
+	for _, token := range store.tokens {
+		// Compare every token in constant time
+		if subtle.ConstantTimeCompare([]byte(token.Token), []byte(value)) == 1 {
+			found = token
+		}
+	}
+	return found
+}
+
+// Check that the given token value may join the named channel
+func (store *TokenStore) authorize(value, channelName string) error {
+	if value == "" {
+		return errors.New("No bearer token was provided")
+	}
+
+	token := store.lookup(value)
+	if token == nil {
+		return errors.New("Bearer token is not valid")
+	}
+
+	if len(token.Channels) == 0 {
+		return nil
+	}
+
+	for _, pattern := range token.Channels {
+		if matchPattern(pattern, channelName) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Bearer token issued to '%s' is not valid for the '%s' channel", token.App, channelName)
+}
+
+// Return the bearer token sent in a local request's Authorization header or
+// in a "nws-token." websocket subprotocol
+func requestToken(r *http.Request) string {
+	// The authentication scheme is case-insensitive
+	if auth := r.Header.Get("Authorization"); len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+
+	for _, subprotocol := range strings.Split(r.Header.Get("Sec-Websocket-Protocol"), ",") {
+		if subprotocol = strings.TrimSpace(subprotocol); strings.HasPrefix(subprotocol, tokenSubprotocolPrefix) {
+			return strings.TrimPrefix(subprotocol, tokenSubprotocolPrefix)
+		}
+	}
+
+	return ""
+}
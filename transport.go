@@ -7,36 +7,56 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	tls "github.com/richtr/go-tls-srp"
 	"github.com/richtr/websocket"
 )
 
-const (
-	// Time allowed to write a message to any websocket.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from any websocket.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from any websocket.
-	maxMessageSize = 8192
-)
+var errSendQueueFull = errors.New("Transport send queue is full. Message dropped.")
 
 type MessageHandler interface {
 	Read(buf []byte) error
 	Write(buf []byte) error
 }
 
+// BinaryMessageHandler is implemented by MessageHandlers that can read and
+// write binary websocket frames. Binary frames received by a Transport whose
+// handler does not implement this interface are discarded.
+type BinaryMessageHandler interface {
+	ReadBinary(buf []byte) error
+	WriteBinary(buf []byte) error
+}
+
 // JSON structure to message sending
 type WireMessage struct {
-	// Proxy message type: "connect", "disconnect", "message", "broadcast"
+	// Proxy message type: "connect", "disconnect", "update", "message",
+	// "broadcast", "ack", "nack", "error"
 	Action string `json:"action"`
 
+	// Optional sender-assigned id of a direct message. Acknowledged with an
+	// "ack" or "nack" message returned to the sender. Broadcasts relayed
+	// between proxies in mesh mode also carry an id to suppress loops.
+	Id string `json:"id,omitempty"`
+
+	// Whether this direct message is a request that expects a reply
+	Request bool `json:"request,omitempty"`
+
+	// Id of the request this direct message replies to
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// Reason the request this direct message replies to failed, or the reason
+	// given in an "error" message
+	Error string `json:"error,omitempty"`
+
+	// Ids of the other peer connections in the channel. Set on "status" replies.
+	Peers []string `json:"peers,omitempty"`
+
+	// Presence metadata of the peer connection in Target. Set on "connect"
+	// and "update" messages.
+	Metadata *PeerMetadata `json:"metadata,omitempty"`
+
 	Source string `json:"source,omitempty"`
 
 	Target string `json:"target,omitempty"`
@@ -44,8 +64,26 @@ type WireMessage struct {
 	// Message contents
 	Payload string `json:"data,omitempty"`
 
+	// Set when this message carries one part of a larger payload
+	Fragment *WireFragment `json:"fragment,omitempty"`
+
+	// Whether Payload holds raw bytes carried in binary frames
+	Binary bool `json:"-"`
+
+	// Number of times this message has been relayed between proxies in mesh mode
+	Hops int `json:"hops,omitempty"`
+
 	// Whether this message originated from a Proxy object
 	fromProxy bool `json:"-"`
+
+	// Proxy connection this message was received from, if any
+	via *Proxy `json:"-"`
+}
+
+// A message waiting in a Transport's outbound queue
+type outboundMessage struct {
+	messageType int
+	data        []byte
 }
 
 type Transport struct {
@@ -53,6 +91,36 @@ type Transport struct {
 	handler MessageHandler
 	open    bool
 	done    chan int // blocks until .Stop() is called
+	quit    chan int // closed when .Stop() is called
+
+	written chan int // closed when writePump exits
+
+	// Whether queued messages are left unwritten when stopped
+	abandoned bool
+
+	// Guards open and abandoned
+	mu sync.RWMutex
+
+	// Outbound messages waiting to be written by writePump
+	send chan outboundMessage
+
+	// Close frame to write once all queued messages have been written
+	closing chan []byte
+
+	// What to do when the outbound queue is full
+	policy SlowConsumerPolicy
+
+	// Number of outbound messages discarded by policy. Accessed atomically.
+	dropped uint64
+
+	// Time allowed to write a message to the websocket.
+	writeWait time.Duration
+
+	// Time allowed to read the next pong message from the websocket.
+	pongWait time.Duration
+
+	// Maximum message size allowed from the websocket. Zero means no limit.
+	maxMessageSize int64
 }
 
 func NewTransport(conn *websocket.Conn, handler MessageHandler) *Transport {
@@ -61,27 +129,170 @@ func NewTransport(conn *websocket.Conn, handler MessageHandler) *Transport {
 		handler: handler,
 
 		done: make(chan int, 1),
+		quit: make(chan int),
+
+		written: make(chan int),
+
+		send:    make(chan outboundMessage, DefaultSendQueueSize),
+		closing: make(chan []byte, 1),
+		policy:  DropOldestMessage,
+
+		writeWait:      DefaultWriteWait,
+		pongWait:       DefaultPongWait,
+		maxMessageSize: DefaultMaxMessageSize,
 	}
 
 	return transport
 }
 
+// Apply the websocket limits of the given service configuration and the
+// given maximum message size to this transport. Must be called before .Start().
+func (t *Transport) configure(config *ServiceConfig, maxMessageSize int64) {
+	t.writeWait = config.WriteWait
+	t.pongWait = config.PongWait
+	t.maxMessageSize = maxMessageSize
+	t.send = make(chan outboundMessage, config.SendQueueSize)
+	t.policy = config.SlowConsumerPolicy
+}
+
 func (t *Transport) Start() {
+	t.mu.Lock()
+	t.open = true
+	t.mu.Unlock()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go t.readPump(&wg)
 	go t.writePump(&wg)
 
-	t.open = true
-
 	wg.Wait()
 }
 
+// Stop this transport. Messages already queued are written before the
+// underlying connection is closed.
 func (t *Transport) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.open {
+		return
+	}
 	t.open = false
 
+	close(t.quit)
+}
+
+// Stop this transport without writing the messages still queued on it and
+// return them instead, e.g. to re-send them over a new connection.
+func (t *Transport) abandon() []outboundMessage {
+	t.mu.Lock()
+	t.abandoned = true
+	t.mu.Unlock()
+
+	t.Stop()
+
+	// Unblock any write still pending on a lost connection
 	t.conn.Close()
+	<-t.written
+
+	queued := []outboundMessage{}
+	for {
+		select {
+		case message := <-t.send:
+			queued = append(queued, message)
+		default:
+			return queued
+		}
+	}
+}
+
+// Whether this transport is currently started
+func (t *Transport) isOpen() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.open
+}
+
+// Number of outbound messages this transport has discarded because its
+// queue was full
+func (t *Transport) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Queue a single message of the given type for writing to the underlying
+// websocket. When the queue is full the transport's SlowConsumerPolicy applies.
+func (t *Transport) writeMessage(messageType int, buf []byte) error {
+	if !t.isOpen() {
+		return errors.New("Transport is not currently active for writing")
+	}
+
+	message := outboundMessage{messageType, buf}
+
+	for {
+		select {
+		case t.send <- message:
+			return nil
+		default:
+		}
+
+		switch t.policy {
+		case DropOldestMessage:
+			// Make room by discarding the message at the head of the queue
+			select {
+			case <-t.send:
+				atomic.AddUint64(&t.dropped, 1)
+			default:
+			}
+			continue
+
+		case DisconnectSlowConsumer:
+			atomic.AddUint64(&t.dropped, 1)
+			log.Printf("Disconnecting slow websocket consumer (%d messages dropped)", t.Dropped())
+			t.Stop()
+			return errSendQueueFull
+		}
+
+		atomic.AddUint64(&t.dropped, 1)
+		return errSendQueueFull
+	}
+}
+
+// Queue a single message of the given type, waiting for room in the outbound
+// queue instead of applying the transport's SlowConsumerPolicy. Used for the
+// fragments of a larger message, which are useless unless all of them arrive.
+func (t *Transport) writeMessageWait(messageType int, buf []byte) error {
+	if !t.isOpen() {
+		return errors.New("Transport is not currently active for writing")
+	}
+
+	select {
+	case t.send <- outboundMessage{messageType, buf}:
+		return nil
+	case <-t.quit:
+	case <-t.written:
+	}
+
+	return errors.New("Transport stopped while waiting to write")
+}
+
+// Send a close frame with the given code and reason to the remote endpoint
+// after all currently queued messages. The underlying connection is left open
+// until .Stop() is called.
+func (t *Transport) Close(closeCode int, reason string) error {
+	if !t.isOpen() {
+		return errors.New("Transport is not currently active for writing")
+	}
+
+	closeMessage := websocket.FormatCloseMessage(closeCode, reason)
+
+	select {
+	case t.closing <- closeMessage:
+		return nil
+	default:
+		return errors.New("Transport is already closing")
+	}
 }
 
 // StopNotify returns a channel that receives a empty integer
@@ -89,7 +300,7 @@ func (t *Transport) Stop() {
 func (t *Transport) StopNotify() <-chan int { return t.done }
 
 func (t *Transport) Read(buf []byte) error {
-	if !t.open {
+	if !t.isOpen() {
 		return errors.New("Transport is not currently active for reading")
 	}
 
@@ -101,7 +312,7 @@ func (t *Transport) Read(buf []byte) error {
 }
 
 func (t *Transport) Write(buf []byte) error {
-	if !t.open {
+	if !t.isOpen() {
 		return errors.New("Transport is not currently active for writing")
 	}
 
@@ -112,12 +323,80 @@ func (t *Transport) Write(buf []byte) error {
 	return t.handler.Write(buf)
 }
 
+// Read a binary message received on this transport
+func (t *Transport) ReadBinary(buf []byte) error {
+	if !t.isOpen() {
+		return errors.New("Transport is not currently active for reading")
+	}
+
+	handler, ok := t.handler.(BinaryMessageHandler)
+	if !ok {
+		return errors.New("Cannot read binary message. Transport handler does not support binary messages")
+	}
+
+	return handler.ReadBinary(buf)
+}
+
+// Write a binary message to this transport
+func (t *Transport) WriteBinary(buf []byte) error {
+	if !t.isOpen() {
+		return errors.New("Transport is not currently active for writing")
+	}
+
+	handler, ok := t.handler.(BinaryMessageHandler)
+	if !ok {
+		return errors.New("Cannot write binary message. Transport handler does not support binary messages")
+	}
+
+	return handler.WriteBinary(buf)
+}
+
+// Encode and write a wire message as a text or binary frame depending on
+// the type of its payload. Fragments wait for room in the outbound queue
+// instead of being dropped so that their message can still be reassembled.
+func (t *Transport) writeWireMessage(message *WireMessage) error {
+	if message.Fragment != nil {
+		return t.writeWireMessageWait(message)
+	}
+
+	if message.Binary {
+		wireData, err := marshalBinaryWireMessage(message)
+		if err != nil {
+			return err
+		}
+		return t.WriteBinary(wireData)
+	}
+
+	wireData, err := marshalWireMessage(message)
+	if err != nil {
+		return err
+	}
+	return t.Write(wireData)
+}
+
+// Encode and queue a wire message, waiting for room in the outbound queue
+func (t *Transport) writeWireMessageWait(message *WireMessage) error {
+	if message.Binary {
+		wireData, err := marshalBinaryWireMessage(message)
+		if err != nil {
+			return err
+		}
+		return t.writeMessageWait(websocket.BinaryMessage, wireData)
+	}
+
+	wireData, err := marshalWireMessage(message)
+	if err != nil {
+		return err
+	}
+	return t.writeMessageWait(websocket.TextMessage, wireData)
+}
+
 // readPump pumps messages from an individual websocket connection to the dispatcher
 func (t *Transport) readPump(wg *sync.WaitGroup) {
-	t.conn.SetReadLimit(maxMessageSize)
-	t.conn.SetReadDeadline(time.Now().Add(pongWait))
+	t.conn.SetReadLimit(t.maxMessageSize)
+	t.conn.SetReadDeadline(time.Now().Add(t.pongWait))
 	t.conn.SetPongHandler(func(string) error {
-		t.conn.SetReadDeadline(time.Now().Add(pongWait))
+		t.conn.SetReadDeadline(time.Now().Add(t.pongWait))
 		return nil
 	})
 
@@ -125,12 +404,21 @@ func (t *Transport) readPump(wg *sync.WaitGroup) {
 
 	for {
 		opCode, buf, err := t.conn.ReadMessage()
-		if err != nil || opCode != websocket.TextMessage {
+		if err != nil {
 			break
 		}
 
 		// Pass incoming message to our assigned message handler
-		if err := t.Read(buf); err != nil {
+		switch opCode {
+		case websocket.TextMessage:
+			err = t.Read(buf)
+		case websocket.BinaryMessage:
+			err = t.ReadBinary(buf)
+		default:
+			err = errors.New("Unsupported websocket message type")
+		}
+
+		if err != nil {
 			log.Printf("err: %v", err)
 		}
 	}
@@ -139,22 +427,70 @@ func (t *Transport) readPump(wg *sync.WaitGroup) {
 	t.done <- 1
 }
 
-// writePump keeps an individual websocket connection alive
+// writePump writes queued messages to an individual websocket connection and
+// keeps it alive. The connection is closed when writePump exits.
 func (t *Transport) writePump(wg *sync.WaitGroup) {
-	ticker := time.NewTicker(pingPeriod)
+	// Send pings with this period. Must be less than pongWait.
+	ticker := time.NewTicker((t.pongWait * 9) / 10)
 	defer func() {
 		ticker.Stop()
+		t.conn.Close()
+		close(t.written)
 	}()
 
 	wg.Done()
 
 	for {
 		select {
+		case message := <-t.send:
+			t.conn.SetWriteDeadline(time.Now().Add(t.writeWait))
+			if err := t.conn.WriteMessage(message.messageType, message.data); err != nil {
+				log.Printf("err: %v", err)
+				return
+			}
+		case closeMessage := <-t.closing:
+			t.flush(closeMessage)
 		case <-ticker.C:
-			t.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := t.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err := t.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(t.writeWait)); err != nil {
+				return
+			}
+		case <-t.quit:
+			t.mu.RLock()
+			abandoned := t.abandoned
+			t.mu.RUnlock()
+
+			if abandoned {
 				return
 			}
+
+			select {
+			case closeMessage := <-t.closing:
+				t.flush(closeMessage)
+			default:
+				t.flush(nil)
+			}
+			return
+		}
+	}
+}
+
+// Write all currently queued messages followed by the given close frame, if
+// any, within a single write deadline
+func (t *Transport) flush(closeMessage []byte) {
+	deadline := time.Now().Add(t.writeWait)
+	t.conn.SetWriteDeadline(deadline)
+
+	for {
+		select {
+		case message := <-t.send:
+			if err := t.conn.WriteMessage(message.messageType, message.data); err != nil {
+				return
+			}
+		default:
+			if closeMessage != nil {
+				t.conn.WriteControl(websocket.CloseMessage, closeMessage, deadline)
+			}
+			return
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package networkwebsockets
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,14 +17,41 @@ import (
 
 func encodeWireMessage(action, source, target, payload string) ([]byte, error) {
 	// Construct proxy wire message
-	m := WireMessage{
+	m := &WireMessage{
 		Action:  action,
 		Source:  source,
 		Target:  target,
 		Payload: payload,
 	}
 
-	return json.Marshal(m) // returns ([]byte, error)
+	return marshalWireMessage(m)
+}
+
+// Encode a complete wire message for sending in a text frame
+func marshalWireMessage(message *WireMessage) ([]byte, error) {
+	return json.Marshal(message) // returns ([]byte, error)
+}
+
+// Build the "ack" (or "nack" if err is not nil) returned to the sender of a
+// direct message. Returns nil if the sender did not request acknowledgement.
+func newDeliveryReceipt(message *WireMessage, err error) *WireMessage {
+	if message.Id == "" {
+		return nil
+	}
+
+	receipt := &WireMessage{
+		Action: "ack",
+		Id:     message.Id,
+		Source: message.Target,
+		Target: message.Source,
+	}
+
+	if err != nil {
+		receipt.Action = "nack"
+		receipt.Payload = err.Error()
+	}
+
+	return receipt
 }
 
 func decodeWireMessage(msg []byte) (WireMessage, error) {
@@ -33,29 +61,104 @@ func decodeWireMessage(msg []byte) (WireMessage, error) {
 	return message, err
 }
 
-func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+func encodeBinaryWireMessage(action, source, target string, payload []byte) ([]byte, error) {
+	// Construct proxy wire message
+	m := &WireMessage{
+		Action:  action,
+		Source:  source,
+		Target:  target,
+		Payload: string(payload),
+		Binary:  true,
+	}
+
+	return marshalBinaryWireMessage(m)
+}
+
+// Binary wire messages are framed as a 4-byte big-endian header length
+// followed by a JSON header (a wire message without "data") and then the
+// raw payload bytes:
+//
+//	+---------------+-------------------+---------------+
+//	| header length | JSON header       | payload bytes |
+//	+---------------+-------------------+---------------+
+func marshalBinaryWireMessage(message *WireMessage) ([]byte, error) {
+	header := *message
+	header.Payload = ""
+
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4, 4+len(headerData)+len(message.Payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(headerData)))
+	buf = append(buf, headerData...)
+	buf = append(buf, message.Payload...)
+
+	return buf, nil
+}
+
+func decodeBinaryWireMessage(msg []byte) (WireMessage, error) {
+	var message WireMessage
+
+	if len(msg) < 4 {
+		return message, errors.New("Binary message is too short to contain a header")
+	}
+
+	headerLength := binary.BigEndian.Uint32(msg[:4])
+	if uint64(headerLength) > uint64(len(msg)-4) {
+		return message, errors.New("Binary message header length exceeds message length")
+	}
+
+	if err := json.Unmarshal(msg[4:4+headerLength], &message); err != nil {
+		return message, err
+	}
+
+	message.Payload = string(msg[4+headerLength:])
+	message.Binary = true
+
+	return message, nil
+}
+
+func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request, config *ServiceConfig) (*websocket.Conn, error) {
 	// Chose a subprotocol from those offered in the client request
 	selectedSubprotocol := ""
 	if subprotocolsStr := strings.TrimSpace(r.Header.Get("Sec-Websocket-Protocol")); subprotocolsStr != "" {
 		// Choose the first subprotocol requested in 'Sec-Websocket-Protocol' header
-		selectedSubprotocol = strings.Split(subprotocolsStr, ",")[0]
+		// that does not carry a bearer token
+		for _, subprotocol := range strings.Split(subprotocolsStr, ",") {
+			if subprotocol = strings.TrimSpace(subprotocol); !strings.HasPrefix(subprotocol, tokenSubprotocolPrefix) {
+				selectedSubprotocol = subprotocol
+				break
+			}
+		}
 	}
 
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  8192,
-		WriteBufferSize: 8192,
+		ReadBufferSize:  config.ReadBufferSize,
+		WriteBufferSize: config.WriteBufferSize,
 		CheckOrigin: func(r *http.Request) bool {
-			return true // allow all cross-origin access
+			return true // origins are checked against the service's OriginPolicy before upgrading
 		},
 	}
 
-	ws, err := upgrader.Upgrade(w, r, map[string][]string{
-		"Access-Control-Allow-Origin":      []string{"*"},
+	responseHeader := http.Header{
 		"Access-Control-Allow-Credentials": []string{"true"},
 		"Access-Control-Allow-Headers":     []string{"content-type"},
-		// Return requested subprotocol(s) as supported so peers can handle it
-		"Sec-Websocket-Protocol": []string{selectedSubprotocol},
-	})
+	}
+
+	// Return the requested subprotocol as supported so peers can handle it.
+	// Bearer tokens are never echoed back.
+	if selectedSubprotocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", selectedSubprotocol)
+	}
+
+	// Only grant cross-origin access to the origin that was accepted
+	if origin := r.Header.Get("Origin"); origin != "" {
+		responseHeader.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); !ok {
 			log.Println(err)
@@ -66,8 +169,42 @@ func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.
 	return ws, nil
 }
 
+// Establish a proxy connection from channel to the remote channel described by
+// record. Nothing is dialed if the remote channel is expected to dial us and is
+// not yet overdue or if a proxy connection to it already exists or is being
+// established.
 func dialProxyFromDNSRecord(record *DNSRecord, channel *Channel) error {
 
+	if !channel.shouldDial(record.Hash_Base64) && !channel.isOverdue(record.Hash_Base64) {
+		return nil
+	}
+
+	if !channel.beginDial(record.Hash_Base64) {
+		return nil
+	}
+	defer channel.endDial(record.Hash_Base64)
+
+	ws, err := dialProxyWebSocket(record, channel)
+	if err != nil {
+		return err
+	}
+
+	// Create, bind and start a new proxy connection
+	proxyConn := NewProxy(ws, true)
+	proxyConn.setHash_Base64(record.Hash_Base64)
+	proxyConn.record = record
+	if err := proxyConn.Start(channel); err != nil {
+		ws.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Open a TLS-SRP websocket connection from channel to the proxy path of the
+// remote channel described by record
+func dialProxyWebSocket(record *DNSRecord, channel *Channel) (*websocket.Conn, error) {
+
 	hosts := [...]string{record.AddrV4.String(), record.AddrV6.String()}
 
 	for i := 0; i < len(hosts); i++ {
@@ -90,8 +227,8 @@ func dialProxyFromDNSRecord(record *DNSRecord, channel *Channel) error {
 		tlsSrpDialer := &TLSSRPDialer{
 			&websocket.Dialer{
 				HandshakeTimeout: time.Duration(10) * time.Second,
-				ReadBufferSize:   8192,
-				WriteBufferSize:  8192,
+				ReadBufferSize:   channel.service.config.ReadBufferSize,
+				WriteBufferSize:  channel.service.config.WriteBufferSize,
 			},
 			&tls.Config{
 				SRPUser:     record.Hash_Base64,
@@ -99,26 +236,27 @@ func dialProxyFromDNSRecord(record *DNSRecord, channel *Channel) error {
 			},
 		}
 
-		ws, _, nErr := tlsSrpDialer.Dial(remoteWSUrl, map[string][]string{
+		ws, resp, nErr := tlsSrpDialer.Dial(remoteWSUrl, map[string][]string{
 			"Origin":                 []string{"localhost"},
 			"Sec-WebSocket-Protocol": []string{"nws-proxy-draft-01"},
+			proxyServiceHashHeader:   []string{channel.serviceHash},
 		})
 		if nErr != nil {
+			// The remote channel already has a link to this channel
+			if resp != nil && resp.StatusCode == 409 {
+				return nil, errDuplicateProxy
+			}
+
 			errStr := fmt.Sprintf("Proxy named web socket connection to wss://%s%s failed: %s", remoteWSUrl.Host, remoteWSUrl.Path, nErr)
-			return errors.New(errStr)
+			return nil, errors.New(errStr)
 		}
 
 		log.Printf("Established proxy named web socket connection to wss://%s%s", remoteWSUrl.Host, remoteWSUrl.Path)
 
-		// Create, bind and start a new proxy connection
-		proxyConn := NewProxy(ws, false)
-		proxyConn.setHash_Base64(record.Hash_Base64)
-		proxyConn.Start(channel)
-
-		return nil
+		return ws, nil
 
 	}
 
-	return errors.New("Could not establish proxy named web socket connection")
+	return nil, errors.New("Could not establish proxy named web socket connection")
 
 }